@@ -0,0 +1,210 @@
+// Package accounting keeps per-application traffic counters, rolled up by
+// day and by month, and persists them to a JSON file.
+package accounting
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+
+	// Rollups older than this are dropped.
+	keepDays   = 62
+	keepMonths = 24
+
+	// UnknownApp is the app of connections whose owner is unknown.
+	UnknownApp = "unknown"
+)
+
+// Counters are the traffic of an app through one route.
+type Counters struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	Flows    int64 `json:"flows"`
+}
+
+func (c *Counters) add(o Counters) {
+	c.Upload += o.Upload
+	c.Download += o.Download
+	c.Flows += o.Flows
+}
+
+// Usage is the traffic of an app, split between direct and proxied
+// connections.
+type Usage struct {
+	Direct Counters `json:"direct"`
+	Proxy  Counters `json:"proxy"`
+}
+
+// Total returns the traffic of both routes.
+func (u Usage) Total() Counters {
+	t := u.Direct
+	t.add(u.Proxy)
+	return t
+}
+
+// Apps maps app names to their usage.
+type Apps map[string]*Usage
+
+func (a Apps) add(app string, direct bool, c Counters) {
+	u, ok := a[app]
+	if !ok {
+		u = new(Usage)
+		a[app] = u
+	}
+	if direct {
+		u.Direct.add(c)
+	} else {
+		u.Proxy.add(c)
+	}
+}
+
+func (a Apps) clone() Apps {
+	c := make(Apps, len(a))
+	for app, u := range a {
+		v := *u
+		c[app] = &v
+	}
+	return c
+}
+
+// Report holds the rollups, keyed by "2006-01-02" for days and "2006-01"
+// for months, in local time.
+type Report struct {
+	Days   map[string]Apps `json:"days"`
+	Months map[string]Apps `json:"months"`
+}
+
+// Accountant counts the traffic of apps.
+type Accountant struct {
+	sync.Mutex
+
+	path   string
+	report Report
+}
+
+// New returns an accountant persisting to path, loading the rollups saved
+// there by a previous run. An empty path keeps them in memory only.
+func New(path string) (*Accountant, error) {
+	a := &Accountant{
+		path: path,
+		report: Report{
+			Days:   make(map[string]Apps),
+			Months: make(map[string]Apps),
+		},
+	}
+	if path == "" {
+		return a, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.report); err != nil {
+		return nil, err
+	}
+	if a.report.Days == nil {
+		a.report.Days = make(map[string]Apps)
+	}
+	if a.report.Months == nil {
+		a.report.Months = make(map[string]Apps)
+	}
+	return a, nil
+}
+
+// Add counts traffic of app at t.
+func (a *Accountant) Add(t time.Time, app string, direct bool, c Counters) {
+	if app == "" {
+		app = UnknownApp
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	for _, k := range []struct {
+		rollups map[string]Apps
+		key     string
+	}{
+		{a.report.Days, t.Format(dayLayout)},
+		{a.report.Months, t.Format(monthLayout)},
+	} {
+		apps, ok := k.rollups[k.key]
+		if !ok {
+			apps = make(Apps)
+			k.rollups[k.key] = apps
+		}
+		apps.add(app, direct, c)
+	}
+}
+
+// Report returns a copy of the rollups.
+func (a *Accountant) Report() *Report {
+	a.Lock()
+	defer a.Unlock()
+
+	r := &Report{
+		Days:   make(map[string]Apps, len(a.report.Days)),
+		Months: make(map[string]Apps, len(a.report.Months)),
+	}
+	for k, apps := range a.report.Days {
+		r.Days[k] = apps.clone()
+	}
+	for k, apps := range a.report.Months {
+		r.Months[k] = apps.clone()
+	}
+	return r
+}
+
+// Save drops old rollups and writes the others to the file, if any.
+func (a *Accountant) Save() error {
+	a.Lock()
+	prune(a.report.Days, keepDays)
+	prune(a.report.Months, keepMonths)
+	data, err := json.MarshalIndent(&a.report, "", "  ")
+	a.Unlock()
+	if err != nil || a.path == "" {
+		return err
+	}
+
+	// Write then rename, so that the file is never left half written.
+	tmp, err := ioutil.TempFile(filepath.Dir(a.path), filepath.Base(a.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+// prune keeps the last n rollups, keys sort chronologically.
+func prune(rollups map[string]Apps, n int) {
+	if len(rollups) <= n {
+		return
+	}
+	keys := make([]string, 0, len(rollups))
+	for k := range rollups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys[:len(keys)-n] {
+		delete(rollups, k)
+	}
+}
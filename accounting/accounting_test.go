@@ -0,0 +1,126 @@
+package accounting
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Traffic is rolled up by local day and month, a second before and after
+// midnight land in different days, and in different months at the end of
+// a month or a year.
+func TestRollover(t *testing.T) {
+	a, err := New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, at := range []time.Time{
+		time.Date(2026, 3, 30, 23, 59, 59, 0, time.Local),
+		time.Date(2026, 3, 31, 0, 0, 0, 0, time.Local),
+		time.Date(2026, 3, 31, 23, 59, 59, 0, time.Local),
+		time.Date(2026, 4, 1, 0, 0, 1, 0, time.Local),
+		time.Date(2026, 12, 31, 23, 59, 59, 0, time.Local),
+		time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local),
+	} {
+		a.Add(at, "firefox", false, Counters{Upload: 1, Download: 10, Flows: 1})
+	}
+	a.Add(time.Date(2026, 3, 31, 12, 0, 0, 0, time.Local), "firefox", true, Counters{Upload: 5})
+
+	r := a.Report()
+	for day, want := range map[string]Counters{
+		"2026-03-30": {1, 10, 1},
+		"2026-03-31": {7, 20, 2},
+		"2026-04-01": {1, 10, 1},
+		"2026-12-31": {1, 10, 1},
+		"2027-01-01": {1, 10, 1},
+	} {
+		if got := r.Days[day]["firefox"].Total(); got != want {
+			t.Errorf("day %s: %+v, want %+v", day, got, want)
+		}
+	}
+	for month, want := range map[string]Counters{
+		"2026-03": {8, 30, 3},
+		"2026-04": {1, 10, 1},
+		"2026-12": {1, 10, 1},
+		"2027-01": {1, 10, 1},
+	} {
+		if got := r.Months[month]["firefox"].Total(); got != want {
+			t.Errorf("month %s: %+v, want %+v", month, got, want)
+		}
+	}
+	if len(r.Days) != 5 || len(r.Months) != 4 {
+		t.Fatalf("%d days and %d months", len(r.Days), len(r.Months))
+	}
+	if u := r.Days["2026-03-31"]["firefox"]; u.Direct != (Counters{Upload: 5}) {
+		t.Fatalf("direct %+v", u.Direct)
+	}
+}
+
+// Saved rollups are loaded back as they were, and the report is a copy.
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	a, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+	a.Add(now, "firefox", false, Counters{1, 2, 1})
+	a.Add(now, "firefox", true, Counters{3, 4, 1})
+	a.Add(now.AddDate(0, -1, 0), "", true, Counters{5, 6, 1})
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved := a.Report()
+	saved.Days["2026-10-19"]["firefox"].Proxy.Upload = 100
+	if a.Report().Days["2026-10-19"]["firefox"].Proxy.Upload != 1 {
+		t.Fatal("report shares counters with the accountant")
+	}
+
+	b, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.Report(), a.Report(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded %+v, saved %+v", got, want)
+	}
+	if b.Report().Months["2026-09"][UnknownApp].Direct != (Counters{5, 6, 1}) {
+		t.Fatalf("unknown app: %+v", b.Report().Months["2026-09"])
+	}
+
+	// Loaded rollups keep counting.
+	b.Add(now, "firefox", false, Counters{1, 1, 1})
+	if got := b.Report().Days["2026-10-19"]["firefox"].Proxy; got != (Counters{2, 3, 2}) {
+		t.Fatalf("after load %+v", got)
+	}
+}
+
+// Old rollups are dropped on save.
+func TestSavePrunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	a, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < keepDays+10; i++ {
+		a.Add(start.AddDate(0, 0, i), "firefox", false, Counters{Flows: 1})
+	}
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	r := a.Report()
+	if len(r.Days) != keepDays {
+		t.Fatalf("%d days kept", len(r.Days))
+	}
+	if _, ok := r.Days[start.Format(dayLayout)]; ok {
+		t.Fatal("oldest day kept")
+	}
+	if _, ok := r.Days[start.AddDate(0, 0, keepDays+9).Format(dayLayout)]; !ok {
+		t.Fatal("last day dropped")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || len(data) == 0 {
+		t.Fatalf("file: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package tun2ray
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zinoulink/tun2ray/d"
+
+	vinternet "github.com/v2fly/v2ray-core/v4/transport/internet"
+)
+
+// SocketProtector is implemented by the host app, usually by forwarding
+// the call to VpnService.protect(), so that sockets opened by tun2ray are
+// not routed back into the TUN.
+type SocketProtector interface {
+	// Protect is called with the file descriptor of every outbound socket
+	// before it is connected. It returns false if the socket could not be
+	// protected, the connection then fails.
+	Protect(fd int) bool
+}
+
+var protectorMu sync.RWMutex
+var socketProtector SocketProtector
+var registerControllers sync.Once
+
+// setSocketProtector sets the protector used for outbound sockets. Controllers
+// can not be unregistered in V2Ray, they are thus registered once and look up
+// the current protector on each call.
+func setSocketProtector(p SocketProtector) error {
+	protectorMu.Lock()
+	socketProtector = p
+	protectorMu.Unlock()
+
+	var err error
+	registerControllers.Do(func() {
+		d.RegisterDialerController(protectSocket)
+		if err = vinternet.RegisterDialerController(protectSocket); err != nil {
+			return
+		}
+		// V2Ray creates UDP sockets of outbounds through the system listener.
+		err = vinternet.RegisterListenerController(protectSocket)
+	})
+	return err
+}
+
+func protectSocket(network, address string, fd uintptr) error {
+	protectorMu.RLock()
+	p := socketProtector
+	protectorMu.RUnlock()
+
+	if p == nil {
+		return nil
+	}
+	if !p.Protect(int(fd)) {
+		if err := disableSocket(int(fd)); err != nil {
+			return errors.New("failed to protect socket for " + network + " " + address + " nor to disable it: " + err.Error())
+		}
+		return errors.New("failed to protect socket for " + network + " " + address)
+	}
+	return nil
+}
+
+var devNullOnce sync.Once
+var devNull *os.File
+var devNullErr error
+
+// disableSocket points fd to /dev/null. V2Ray only logs controller errors,
+// the connect or bind that follows then fails with ENOTSOCK rather than
+// going out unprotected into the TUN. The fd number is still owned, and
+// closed, by the caller.
+func disableSocket(fd int) error {
+	devNullOnce.Do(func() {
+		devNull, devNullErr = os.Open(os.DevNull)
+	})
+	if devNullErr != nil {
+		return devNullErr
+	}
+	return unix.Dup3(int(devNull.Fd()), fd, unix.O_CLOEXEC)
+}
@@ -0,0 +1,105 @@
+package tun2ray
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	vnet "github.com/v2fly/v2ray-core/v4/common/net"
+	vinternet "github.com/v2fly/v2ray-core/v4/transport/internet"
+)
+
+// recordingProtector records the fds it is asked to protect, and fails to
+// protect them if refuse is set.
+type recordingProtector struct {
+	sync.Mutex
+	fds    []int
+	refuse bool
+}
+
+func (p *recordingProtector) Protect(fd int) bool {
+	p.Lock()
+	defer p.Unlock()
+	p.fds = append(p.fds, fd)
+	return !p.refuse
+}
+
+func (p *recordingProtector) protected(t *testing.T, conn syscall.Conn) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		p.Lock()
+		defer p.Unlock()
+		for _, protected := range p.fds {
+			if protected == int(fd) {
+				return
+			}
+		}
+		t.Errorf("fd %d not protected, got %v", fd, p.fds)
+	})
+}
+
+func TestSocketProtector(t *testing.T) {
+	p := &recordingProtector{}
+	if err := setSocketProtector(p); err != nil {
+		t.Fatal(err)
+	}
+	defer setSocketProtector(nil)
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dest := vnet.DestinationFromAddr(l.Addr())
+
+	// TCP outbounds go through the system dialer.
+	conn, err := vinternet.DialSystem(context.Background(), dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.protected(t, conn.(syscall.Conn))
+	conn.Close()
+
+	// UDP outbounds go through the system listener.
+	pc, err := vinternet.ListenSystemPacket(context.Background(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.protected(t, pc.(syscall.Conn))
+	pc.Close()
+}
+
+// Sockets that could not be protected are not used, V2Ray outbounds fail to
+// connect rather than loop back into the TUN.
+func TestSocketProtectorRefused(t *testing.T) {
+	p := &recordingProtector{refuse: true}
+	if err := setSocketProtector(p); err != nil {
+		t.Fatal(err)
+	}
+	defer setSocketProtector(nil)
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := vinternet.DialSystem(context.Background(), vnet.DestinationFromAddr(l.Addr()), nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialed through a socket that was not protected")
+	}
+	pc, err := vinternet.ListenSystemPacket(context.Background(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, nil)
+	if err == nil {
+		pc.Close()
+		t.Fatal("listened on a socket that was not protected")
+	}
+	if len(p.fds) != 2 {
+		t.Fatalf("asked to protect %v", p.fds)
+	}
+}
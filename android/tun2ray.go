@@ -1,143 +1,262 @@
 package tun2ray
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/zinoulink/tun2ray/dnsfallback"
+	"github.com/zinoulink/tun2ray/d"
+	"github.com/zinoulink/tun2ray/engine"
 	"github.com/zinoulink/tun2ray/v2ray"
 
-	vcore "v2ray.com/core"
-	vproxyman "v2ray.com/core/app/proxyman"
-	vbytespool "v2ray.com/core/common/bytespool"
-	"v2ray.com/core/common/session"
-
 	"github.com/eycorsican/go-tun2socks/core"
+	"golang.org/x/sys/unix"
 )
 
-var lwipStack core.LWIPStack
-var v *vcore.Instance
-var isStopped = false
+type state int
+
+const (
+	stateStopped state = iota
+	stateRunning
+)
+
+// minMTU is the smallest datagram IPv4 hosts must accept, and maxMTU the
+// largest IP packet.
+const (
+	minMTU = 576
+	maxMTU = 65535
+)
+
+// tunnel is a running tun2ray, from the TUN device to V2Ray.
+type tunnel struct {
+	tun      *os.File
+	blocking bool // whether the host gave a blocking fd
+	stack    core.LWIPStack
+	engine   *engine.Engine
+	closed   int32         // accessed atomically, set once Stop begins
+	copyDone chan struct{} // closed when the main loop returns
+}
+
+// mu guards the lifecycle, Start, Stop and Restart never run concurrently.
+var mu sync.Mutex
+var currentState = stateStopped
+var current *tunnel
 
 // Start sets up lwIP stack, starts a V2Ray instance and registers the instance as the
-// connection handler for tun2socks.
-func Start(fd int, Config string, IsUDPEnabled bool, MTU int) string {
+// connection handler for tun2socks. Options is a JSON object of engine.Options, unknown
+// fields are ignored and missing ones take their default value. Every outbound socket
+// is passed to protector before it connects, protector may be nil. If resolver is not
+// nil, connections are routed per app according to the exceptions of Options, or to
+// the lists given to SetExceptions. V2Ray loads geoip.dat and geosite.dat from the
+// assetDir option, or from the current directory if it is empty, unless they are given
+// to SetGeoData.
+// Start does nothing if tun2ray is already running.
+func Start(fd int, Config string, Options string, protector SocketProtector, resolver UidResolver) string {
+	mu.Lock()
+	defer mu.Unlock()
 
-	// Change V2ray asset path to the current path
-	// to access geosite.dat & geoipdat
-	path, err := os.Getwd()
-	if err != nil {
+	if currentState == stateRunning {
+		return ""
+	}
+	if err := start(fd, Config, Options, protector, resolver); err != nil {
+		return fmt.Sprintln(err.Error())
+	}
+	fmt.Println("Running tun2ray")
+	return ""
+}
+
+// Stop stops V2Ray and the lwIP stack, and waits for the main loop to exit.
+// Stop does nothing if tun2ray is not running.
+func Stop() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := stop(); err != nil {
 		return fmt.Sprintln(err.Error())
 	}
-	os.Setenv("v2ray.location.asset", path)
+	return ""
+}
 
-	// Share the buffer pool.
-	core.SetBufferPool(vbytespool.GetPool(core.BufSize))
+// Restart stops tun2ray if it is running, and starts it again with the given
+// parameters, see Start.
+func Restart(fd int, Config string, Options string, protector SocketProtector, resolver UidResolver) string {
+	mu.Lock()
+	defer mu.Unlock()
 
-	// Converte config to bytes.
-	configBytes := []byte(Config)
+	if err := stop(); err != nil {
+		return fmt.Sprintln(err.Error())
+	}
+	if err := start(fd, Config, Options, protector, resolver); err != nil {
+		return fmt.Sprintln(err.Error())
+	}
+	fmt.Println("Restarted tun2ray")
+	return ""
+}
 
-	// Start the V2Ray instance.
-	v, err = vcore.StartInstance("json", configBytes)
+// IsRunning reports whether tun2ray is running.
+func IsRunning() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return currentState == stateRunning
+}
+
+func start(fd int, config string, options string, protector SocketProtector, resolver UidResolver) error {
+	opts, err := engine.ParseOptions(options)
 	if err != nil {
-		return fmt.Sprintln("start V instance failed: ", err.Error())
+		return errors.New("invalid options: " + err.Error())
+	}
+	if opts.MTU < minMTU || opts.MTU > maxMTU {
+		return fmt.Errorf("invalid MTU %d, it must be between %d and %d", opts.MTU, minMTU, maxMTU)
+	}
+	if exceptions != nil {
+		opts.Exceptions = exceptions.apply(opts.Exceptions)
 	}
 
-	// Configure sniffing settings for traffic coming from tun2socks.
-	var validSniffings []string
-	sniffings := strings.Split("http,tls", ",")
-	for _, s := range sniffings {
-		if s == "http" || s == "tls" {
-			validSniffings = append(validSniffings, s)
+	// Set V2Ray asset path to access geosite.dat & geoip.dat
+	if opts.AssetDir == "" {
+		path, err := os.Getwd()
+		if err != nil {
+			return err
 		}
+		opts.AssetDir = path
 	}
-	sniffingConfig := &vproxyman.SniffingConfig{
-		Enabled:             true,
-		DestinationOverride: validSniffings,
+
+	// Protect sockets opened by V2Ray from being routed into the TUN.
+	if err := setSocketProtector(protector); err != nil {
+		return errors.New("register socket protector failed: " + err.Error())
 	}
-	if len(validSniffings) == 0 {
-		sniffingConfig.Enabled = false
+
+	// Route connections per app.
+	var lookup d.ProcessLookup
+	if resolver != nil {
+		lookup = uidLookup(resolver)
 	}
-	ctx := ContextWithSniffingConfig(context.Background(), sniffingConfig)
 
-	// MakeTunFile returns an os.File object from a TUN file descriptor `fd`.
-	tun := os.NewFile(uintptr(fd), "")
-	// Write IP packets back to TUN.
+	// Open the TUN device. The fd is duplicated so that closing our file on
+	// Stop leaves the one owned by the host open, and made non-blocking so
+	// that Stop can interrupt the pending read of the main loop. The flag is
+	// shared with the fd of the host, Stop restores it.
+	tunFd, err := syscall.Dup(fd)
+	if err != nil {
+		return errors.New("dup TUN fd failed: " + err.Error())
+	}
+	flags, err := unix.FcntlInt(uintptr(tunFd), unix.F_GETFL, 0)
+	if err == nil {
+		err = syscall.SetNonblock(tunFd, true)
+	}
+	if err != nil {
+		syscall.Close(tunFd)
+		return errors.New("set TUN fd non-blocking failed: " + err.Error())
+	}
+	t := &tunnel{
+		tun:      os.NewFile(uintptr(tunFd), "tun"),
+		blocking: flags&unix.O_NONBLOCK == 0,
+		copyDone: make(chan struct{}),
+	}
+
+	// Start the V2Ray instance.
+	t.engine, err = engine.New([]byte(config), opts, lookup)
+	if err != nil {
+		t.restoreBlocking()
+		t.tun.Close()
+		return err
+	}
+
+	// Write IP packets back to TUN. This is called from the lwIP thread, it
+	// must not wait for the lifecycle lock held by Stop.
 	core.RegisterOutputFn(func(data []byte) (int, error) {
-		if isStopped {
-			fmt.Println("tunDev is Closed")
-			return 0, nil
+		if atomic.LoadInt32(&t.closed) != 0 {
+			return 0, errors.New("tunDev is Closed")
 		}
-		return tun.Write(data)
+		n, err := t.tun.Write(data)
+		engine.Tun.Written(n)
+		return n, err
 	})
 
 	// Register tun2socks connection handlers.
-	TCPConnHandler := v2ray.NewTCPHandler(ctx, v)
-	var UDPConnHandler core.UDPConnHandler
-	if IsUDPEnabled {
-		UDPConnHandler = v2ray.NewUDPHandler(ctx, v, 1*time.Minute)
-	} else {
-		UDPConnHandler = dnsfallback.NewUDPHandler()
-	}
-
-	core.RegisterTCPConnHandler(TCPConnHandler)
-	core.RegisterUDPConnHandler(UDPConnHandler)
+	t.engine.Register()
 
-	isStopped = false
-
-	if lwipStack == nil {
-		// Setup the lwIP stack.
-		lwipStack = core.NewLWIPStack()
-	}
+	// Setup the lwIP stack.
+	t.stack = core.NewLWIPStack()
 
-	// ProcessInputPackets reads packets from a TUN device `tun` and writes them to `lwipStack`
-	// It's the main loop
-	buf := make([]byte, MTU)
+	// Read packets from the TUN device and write them to the lwIP stack,
+	// it's the main loop.
+	buf := make([]byte, opts.MTU)
 	go func() {
-		_, err := io.CopyBuffer(lwipStack, tun, buf)
-		if err != nil {
-			fmt.Println("copying data failed: %v", err)
-			return
+		defer close(t.copyDone)
+		_, err := io.CopyBuffer(t.stack, engine.Tun.Reader(t.tun), buf)
+		if err != nil && atomic.LoadInt32(&t.closed) == 0 {
+			fmt.Printf("copying data failed: %v\n", err)
 		}
 	}()
 
-	fmt.Println("Running tun2ray")
-	return ""
+	current = t
+	currentState = stateRunning
+	return nil
 }
 
-// Stop V2Ray, close lwipStack
-func Stop() string {
-	isStopped = true
-	if lwipStack != nil {
-		err := lwipStack.Close()
-		if err != nil {
-			return fmt.Sprintln(err.Error())
-		}
-		lwipStack = nil
+func stop() error {
+	if currentState == stateStopped {
+		return nil
 	}
-	if v != nil {
-		err := v.Close()
+	t := current
+	current = nil
+	currentState = stateStopped
+
+	atomic.StoreInt32(&t.closed, 1)
+
+	// Interrupt the main loop and wait for it to exit, so that no packet
+	// is written to the stack once it is closed. A deadline leaves the fd
+	// open to restore its flag, closing it is the fallback.
+	var blockingErr, tunErr error
+	if err := t.tun.SetReadDeadline(time.Now()); err != nil {
+		tunErr = t.tun.Close()
+		<-t.copyDone
+	} else {
+		<-t.copyDone
+		blockingErr = t.restoreBlocking()
+		tunErr = t.tun.Close()
+	}
+
+	stackErr := t.stack.Close()
+	engineErr := t.engine.Close()
+
+	for _, err := range []error{blockingErr, tunErr, stackErr, engineErr} {
 		if err != nil {
-			return fmt.Sprintln(err.Error())
+			return err
 		}
-		v = nil
 	}
-	return ""
+	return nil
+}
+
+// restoreBlocking makes the TUN fd blocking again if the host gave it so.
+func (t *tunnel) restoreBlocking() error {
+	if !t.blocking {
+		return nil
+	}
+	rc, err := t.tun.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var nonblockErr error
+	err = rc.Control(func(fd uintptr) {
+		nonblockErr = syscall.SetNonblock(int(fd), false)
+	})
+	if err != nil {
+		return err
+	}
+	return nonblockErr
 }
 
-// ContextWithSniffingConfig is a wrapper of session.ContextWithContent.
-// Deprecated. Use session.ContextWithContent directly.
-func ContextWithSniffingConfig(ctx context.Context, c *vproxyman.SniffingConfig) context.Context {
-	content := session.ContentFromContext(ctx)
-	if content == nil {
-		content = new(session.Content)
-		ctx = session.ContextWithContent(ctx, content)
-	}
-	content.SniffingRequest.Enabled = c.Enabled
-	content.SniffingRequest.OverrideDestinationForProtocol = c.DestinationOverride
-	return ctx
+// SetGeoData makes V2Ray load geoip.dat and geosite.dat from memory instead
+// of the asset directory, it should be called before Start. A nil slice
+// reverts to the file in the asset directory.
+func SetGeoData(geoip []byte, geosite []byte) {
+	v2ray.SetAsset("geoip.dat", geoip)
+	v2ray.SetAsset("geosite.dat", geosite)
 }
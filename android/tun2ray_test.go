@@ -0,0 +1,81 @@
+package tun2ray
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const testConfig = `{"outbounds":[{"protocol":"freedom"}]}`
+
+// tunPair returns the fd given to Start, standing for the TUN fd of the
+// host, and the other end of the socket pair.
+func tunPair(t *testing.T) (int, int) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+	})
+	return fds[0], fds[1]
+}
+
+func isBlocking(t *testing.T, fd int) bool {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flags&unix.O_NONBLOCK == 0
+}
+
+// Start and Stop leave the fd of the host open and blocking, and the main
+// loop may be reading a packet while Stop runs.
+func TestStartStopStart(t *testing.T) {
+	fd, peer := tunPair(t)
+	// A UDP packet from 1.1.1.1 to 2.2.2.2 without payload.
+	packet := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2}
+	for i := 0; i < 3; i++ {
+		if s := Start(fd, testConfig, `{"logLevel":"none"}`, nil, nil); s != "" {
+			t.Fatal(s)
+		}
+		if !IsRunning() {
+			t.Fatal("not running after Start")
+		}
+		if s := Start(fd, testConfig, "", nil, nil); s != "" {
+			t.Fatalf("second Start: %s", s)
+		}
+		go syscall.Write(peer, packet)
+		if s := Stop(); s != "" {
+			t.Fatal(s)
+		}
+		if IsRunning() {
+			t.Fatal("running after Stop")
+		}
+		if !isBlocking(t, fd) {
+			t.Fatal("host fd left non-blocking")
+		}
+		if s := Stop(); s != "" {
+			t.Fatalf("second Stop: %s", s)
+		}
+	}
+	if _, err := syscall.Write(peer, packet); err != nil {
+		t.Fatalf("host fd closed: %v", err)
+	}
+}
+
+func TestStartInvalidMTU(t *testing.T) {
+	fd, _ := tunPair(t)
+	for _, mtu := range []string{"0", "-1", "100", "70000"} {
+		s := Start(fd, testConfig, `{"mtu":`+mtu+`}`, nil, nil)
+		if !strings.Contains(s, "invalid MTU") {
+			t.Fatalf("MTU %s: got %q", mtu, s)
+		}
+		if IsRunning() {
+			t.Fatalf("MTU %s: running", mtu)
+		}
+	}
+}
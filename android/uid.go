@@ -0,0 +1,110 @@
+package tun2ray
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/zinoulink/tun2ray/d"
+	"github.com/zinoulink/tun2ray/engine"
+)
+
+// UidResolver is implemented by the host app to find the app owning a
+// connection, usually with ConnectivityManager.getConnectionOwnerUid and
+// PackageManager.getNameForUid.
+type UidResolver interface {
+	// GetConnectionOwnerUid returns the UID owning the connection, or -1 if
+	// it is not found. protocol is either IPPROTO_TCP (6) or IPPROTO_UDP (17).
+	GetConnectionOwnerUid(protocol int, srcIP string, srcPort int, dstIP string, dstPort int) int
+
+	// GetPackageName returns the package name of uid, or an empty string.
+	GetPackageName(uid int) string
+}
+
+// appLists are the per-app lists given to SetExceptions.
+type appLists struct {
+	defaultDirect bool
+	direct        []string
+	proxy         []string
+}
+
+// exceptions are the lists last given to SetExceptions, nil if it was never
+// called. Guarded by mu.
+var exceptions *appLists
+
+// apply returns opts with the default route and the direct and proxy lists
+// replaced by l.
+func (l *appLists) apply(opts engine.ExceptionOptions) engine.ExceptionOptions {
+	opts.Default = "proxy"
+	if l.defaultDirect {
+		opts.Default = "direct"
+	}
+	opts.Direct = l.direct
+	opts.Proxy = l.proxy
+	return opts
+}
+
+// SetExceptions sets the per-app routing rules. direct and proxy are comma
+// separated lists of package names or UIDs. Apps matching none of the lists
+// go direct if defaultDirect is true, and to the proxy otherwise. The lists
+// apply to new connections if tun2ray is running, and take precedence over
+// the exceptions of Options on the next Start. App outbounds and the send
+// through address of Options are kept.
+func SetExceptions(defaultDirect bool, direct string, proxy string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	exceptions = &appLists{
+		defaultDirect: defaultDirect,
+		direct:        d.SplitList(direct),
+		proxy:         d.SplitList(proxy),
+	}
+	if currentState == stateRunning {
+		// Only the default route can name an outbound, and it is
+		// direct or proxy here, this can not fail.
+		current.engine.SetExceptionOptions(exceptions.apply(current.engine.ExceptionOptions()))
+	}
+}
+
+// uidLookup returns a d.ProcessLookup backed by resolver.
+func uidLookup(resolver UidResolver) d.ProcessLookup {
+	return func(network string, src, dst net.Addr) (*d.Process, error) {
+		if dst == nil {
+			return nil, errors.New("unknown destination")
+		}
+		protocol := syscall.IPPROTO_TCP
+		if network == "udp" {
+			protocol = syscall.IPPROTO_UDP
+		}
+		srcIP, srcPort, err := splitHostPort(src)
+		if err != nil {
+			return nil, err
+		}
+		dstIP, dstPort, err := splitHostPort(dst)
+		if err != nil {
+			return nil, err
+		}
+		uid := resolver.GetConnectionOwnerUid(protocol, srcIP, srcPort, dstIP, dstPort)
+		if uid < 0 {
+			return nil, errors.New("not found")
+		}
+		name := resolver.GetPackageName(uid)
+		if name == "" {
+			name = strconv.Itoa(uid)
+		}
+		return &d.Process{Name: name, UID: uid}, nil
+	}
+}
+
+func splitHostPort(addr net.Addr) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
@@ -0,0 +1,18 @@
+// +build !windows
+
+package api
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on a Unix socket created with mode 0600. The umask is
+// set around the bind so that the socket is never accessible by others, it
+// briefly applies to files created by other goroutines too.
+func listenUnix(path string) (net.Listener, error) {
+	umask := syscall.Umask(0177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(umask)
+	return ln, err
+}
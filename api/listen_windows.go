@@ -0,0 +1,13 @@
+// +build windows
+
+package api
+
+import (
+	"net"
+)
+
+// listenUnix listens on a Unix socket, which inherits the permissions of
+// its directory as Windows has no umask.
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
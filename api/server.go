@@ -0,0 +1,348 @@
+// Package api implements a local management API for a running tun2ray,
+// served as JSON over HTTP on a Unix socket or a TCP address.
+//
+//	GET    /status          engine status
+//	GET    /connections     active connections, with ?closed=1 also the
+//	                        recently closed ones
+//	DELETE /connections     kill connections by ?id=, ?process= and/or
+//	                        ?destination=
+//	GET    /stats           V2Ray stats counters
+//	GET    /metrics         metrics in the Prometheus text format
+//	GET    /usage           traffic of each app by day and by month
+//	GET    /exceptions      per-app exceptions
+//	PUT    /exceptions      replace per-app exceptions
+//	GET    /rules           routing rules
+//	PUT    /rules           replace routing rules
+//	POST   /rules/reload    reload the rules file
+//	POST   /reload          reload V2Ray config
+//	GET    /loglevel        log level
+//	PUT    /loglevel        change log level
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+	"github.com/zinoulink/tun2ray/d"
+	"github.com/zinoulink/tun2ray/engine"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// Backend gives access to the running engine.
+type Backend interface {
+	// Engine returns the running engine.
+	Engine() *engine.Engine
+	// Reload reloads V2Ray config, replacing the running engine.
+	Reload() error
+}
+
+type Server struct {
+	backend Backend
+	token   string
+	mux     *http.ServeMux
+	srv     *http.Server
+}
+
+// NewServer creates a server for backend. If token is not empty, requests
+// must carry it as a bearer token in the Authorization header.
+func NewServer(backend Backend, token string) *Server {
+	s := &Server{
+		backend: backend,
+		token:   token,
+		mux:     http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/connections", s.handleConnections)
+	s.mux.HandleFunc("/stats", s.handleStats)
+	s.mux.HandleFunc("/usage", s.handleUsage)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.HandleFunc("/exceptions", s.handleExceptions)
+	s.mux.HandleFunc("/rules", s.handleRules)
+	s.mux.HandleFunc("/rules/reload", s.handleReloadRules)
+	s.mux.HandleFunc("/reload", s.handleReload)
+	s.mux.HandleFunc("/loglevel", s.handleLogLevel)
+	s.srv = &http.Server{Handler: s}
+	return s
+}
+
+// Listen starts serving on addr, either "unix:/path/to/socket" or a TCP
+// address such as "127.0.0.1:9090". The Unix socket is only accessible
+// by the user running tun2ray. A TCP address other than loopback requires
+// a token, without one requests must name a loopback host and come from
+// outside of a browser.
+func (s *Server) Listen(addr string) error {
+	var ln net.Listener
+	var err error
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		// Remove the socket left by a previous run, but no other file.
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		ln, err = listenUnix(path)
+		if err != nil {
+			return err
+		}
+	} else {
+		if s.token == "" && !isLoopback(addr) {
+			return errors.New("API on " + addr + " requires a token, only loopback addresses can go without")
+		}
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		if s.token == "" {
+			log.Warnf("API is listening on %s without a token", addr)
+		}
+	}
+	go func() {
+		if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("API server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// isLoopback reports whether the TCP address addr only listens on
+// loopback, an empty host listens on every interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+	} else if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		// Without a token, a web page could reach a loopback port
+		// through DNS rebinding or a cross-origin request. Browsers
+		// send the name they resolved as Host, and an Origin with
+		// requests from pages, which local clients do not.
+		if r.Header.Get("Origin") != "" || !isLoopbackHost(r.Host) {
+			writeError(w, http.StatusForbidden, errors.New("forbidden, set a token to use the API from a browser or another host"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// isLoopbackHost reports whether host, the Host header of a request, names
+// a loopback address.
+func isLoopbackHost(host string) bool {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		// No port.
+		host = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), "0")
+	}
+	return isLoopback(host)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// parseFilter reads the connections to kill from the query, at least one
+// criterion is required so that all connections are not killed by mistake.
+func parseFilter(r *http.Request) (conntrack.Filter, error) {
+	q := r.URL.Query()
+	filter := conntrack.Filter{
+		Process:     q.Get("process"),
+		Destination: q.Get("destination"),
+	}
+	if id := q.Get("id"); id != "" {
+		n, err := strconv.ParseUint(id, 10, 64)
+		if err != nil || n == 0 {
+			return filter, errors.New("invalid connection id: " + id)
+		}
+		filter.ID = n
+	}
+	if filter.IsZero() {
+		return filter, errors.New("id, process or destination is required")
+	}
+	return filter, nil
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, s.backend.Engine().Status())
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	e := s.backend.Engine()
+	if r.Method == http.MethodDelete {
+		filter, err := parseFilter(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		ids := e.KillConnections(filter)
+		if ids == nil {
+			ids = []uint64{}
+		}
+		writeJSON(w, map[string][]uint64{"killed": ids})
+		return
+	}
+	conns := e.Connections()
+	if r.URL.Query().Get("closed") == "1" {
+		conns = append(conns, e.ClosedConnections()...)
+	}
+	writeJSON(w, conns)
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, s.backend.Engine().Usage())
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := s.backend.Engine().WriteMetrics(w); err != nil {
+		log.Warnf("write metrics failed: %v", err)
+	}
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	counters, err := s.backend.Engine().Stats()
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, counters)
+}
+
+func (s *Server) handleExceptions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	e := s.backend.Engine()
+	if r.Method == http.MethodPut {
+		var opts engine.ExceptionOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := e.SetExceptionOptions(opts); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	writeJSON(w, e.ExceptionOptions())
+}
+
+func (s *Server) handleRules(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	e := s.backend.Engine()
+	if r.Method == http.MethodPut {
+		var rules []d.RuleConfig
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rules); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := e.SetRules(rules); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	writeJSON(w, e.RuleConfigs())
+}
+
+func (s *Server) handleReloadRules(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	e := s.backend.Engine()
+	if err := e.ReloadRules(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, e.RuleConfigs())
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if err := s.backend.Reload(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, s.backend.Engine().Status())
+}
+
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	e := s.backend.Engine()
+	if r.Method == http.MethodPut {
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := e.SetLogLevel(req.Level); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	writeJSON(w, map[string]string{"level": e.LogLevel()})
+}
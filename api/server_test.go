@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Without a token, requests to a TCP listener must name a loopback host and
+// carry no Origin, so that web pages can not reach the API.
+func TestServeHTTPNoToken(t *testing.T) {
+	s := NewServer(nil, "")
+	tcp := context.WithValue(context.Background(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9090})
+	unix := context.WithValue(context.Background(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/tun2ray.sock", Net: "unix"})
+	for _, test := range []struct {
+		ctx    context.Context
+		host   string
+		origin string
+		status int
+	}{
+		{tcp, "127.0.0.1:9090", "", http.StatusNotFound},
+		{tcp, "localhost:9090", "", http.StatusNotFound},
+		{tcp, "[::1]:9090", "", http.StatusNotFound},
+		{tcp, "localhost", "", http.StatusNotFound},
+		{tcp, "rebind.example.com:9090", "", http.StatusForbidden},
+		{tcp, "127.0.0.1:9090", "https://example.com", http.StatusForbidden},
+		{tcp, "127.0.0.1:9090", "null", http.StatusForbidden},
+		{unix, "anything", "", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest("POST", "http://"+test.host+"/nonexistent", nil).WithContext(test.ctx)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("Host %s, Origin %q: got %d, want %d", test.host, test.origin, w.Code, test.status)
+		}
+	}
+}
+
+func TestServeHTTPToken(t *testing.T) {
+	s := NewServer(nil, "secret")
+	tcp := context.WithValue(context.Background(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 9090})
+	for auth, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusNotFound,
+	} {
+		r := httptest.NewRequest("GET", "http://192.168.1.2:9090/nonexistent", nil).WithContext(tcp)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("Authorization %q: got %d, want %d", auth, w.Code, status)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+// Package blocklist loads domain blocklists in the hosts, AdBlock and
+// plain formats, and compiles them into a compact suffix trie.
+package blocklist
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Entry flags.
+const (
+	flagBlock uint8 = 1 << iota
+	flagAllow
+)
+
+// node is a label of the trie, its children are contiguous in List.nodes
+// and sorted by label.
+type node struct {
+	label    uint32 // offset of the label in List.labels
+	labelLen uint8
+	flags    uint8
+	children uint32
+	count    uint32
+}
+
+// List is a compiled blocklist. A domain is blocked if it or one of its
+// parents is blocked, unless it or one of its parents is allowed.
+type List struct {
+	labels string
+	nodes  []node // the root first
+	size   int
+	hits   uint64
+}
+
+// Blocked reports whether domain is blocked, l may be nil.
+func (l *List) Blocked(domain string) bool {
+	if l == nil || domain == "" {
+		return false
+	}
+	domain = canonical(domain)
+
+	var flags uint8
+	n := &l.nodes[0]
+	for end := len(domain); end > 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		child, ok := l.child(n, domain[start:end])
+		if !ok {
+			break
+		}
+		n = child
+		flags |= n.flags
+		end = start - 1
+	}
+	if flags&flagBlock == 0 || flags&flagAllow != 0 {
+		return false
+	}
+	atomic.AddUint64(&l.hits, 1)
+	return true
+}
+
+func (l *List) child(n *node, label string) (*node, bool) {
+	children := l.nodes[n.children : n.children+n.count]
+	i := sort.Search(len(children), func(i int) bool {
+		return l.label(&children[i]) >= label
+	})
+	if i < len(children) && l.label(&children[i]) == label {
+		return &children[i], true
+	}
+	return nil, false
+}
+
+func (l *List) label(n *node) string {
+	return l.labels[n.label : n.label+uint32(n.labelLen)]
+}
+
+// Len returns the number of blocked domains.
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	return l.size
+}
+
+// Hits returns how many times a domain was found blocked.
+func (l *List) Hits() uint64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.hits)
+}
+
+// entry is a domain to compile, its key is its labels from the top-level
+// one, separated by zero bytes so that keys sort like label sequences.
+type entry struct {
+	key  string
+	flag uint8
+}
+
+// Builder collects domains to compile into a List.
+type Builder struct {
+	entries []entry
+}
+
+// Block adds domain to the blocked domains, it reports whether domain is
+// valid.
+func (b *Builder) Block(domain string) bool {
+	return b.add(domain, flagBlock)
+}
+
+// Allow adds domain to the allowed domains, which override the blocked
+// ones, it reports whether domain is valid.
+func (b *Builder) Allow(domain string) bool {
+	return b.add(domain, flagAllow)
+}
+
+func (b *Builder) add(domain string, flag uint8) bool {
+	domain = canonical(domain)
+	if !valid(domain) {
+		return false
+	}
+	var key strings.Builder
+	key.Grow(len(domain))
+	for end := len(domain); end > 0; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		if key.Len() > 0 {
+			key.WriteByte(0)
+		}
+		key.WriteString(domain[start:end])
+		end = start - 1
+	}
+	b.entries = append(b.entries, entry{key.String(), flag})
+	return true
+}
+
+// Parse reads a list, guessing the format of each line: hosts file lines
+// such as "0.0.0.0 ads.example.com", AdBlock rules such as
+// "||ads.example.com^" and their "@@" exceptions, or one domain per line.
+// Comments and rules that are not about whole domains are skipped. It
+// returns the number of domains added.
+func (b *Builder) Parse(r io.Reader) (int, error) {
+	return b.parse(r, false)
+}
+
+// ParseAllow reads a list like Parse, but all its domains are allowed.
+func (b *Builder) ParseAllow(r io.Reader) (int, error) {
+	return b.parse(r, true)
+}
+
+func (b *Builder) parse(r io.Reader, allowAll bool) (int, error) {
+	added := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		domains, allow := parseLine(scanner.Text())
+		flag := flagBlock
+		if allow || allowAll {
+			flag = flagAllow
+		}
+		for _, domain := range domains {
+			if b.add(domain, flag) {
+				added++
+			}
+		}
+	}
+	return added, scanner.Err()
+}
+
+// parseLine returns the domains of a list line, and whether they are
+// AdBlock exceptions.
+func parseLine(line string) ([]string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '[' || line[0] == '#' {
+		return nil, false
+	}
+	if strings.HasPrefix(line, "@@||") {
+		return parseAdBlock(line[4:]), true
+	}
+	if strings.HasPrefix(line, "||") {
+		return parseAdBlock(line[2:]), false
+	}
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) >= 2 && net.ParseIP(fields[0]) != nil:
+		return fields[1:], false
+	case len(fields) == 1:
+		return []string{strings.TrimPrefix(fields[0], "*.")}, false
+	}
+	return nil, false
+}
+
+// parseAdBlock returns the domain of the AdBlock rule "domain^", which may
+// only be followed by "|" or the $important option.
+func parseAdBlock(rule string) []string {
+	i := strings.IndexByte(rule, '^')
+	if i < 0 {
+		return nil
+	}
+	switch rule[i+1:] {
+	case "", "|", "$important":
+		return []string{rule[:i]}
+	}
+	return nil
+}
+
+func canonical(domain string) string {
+	return strings.ToLower(strings.Trim(domain, "."))
+}
+
+// valid reports whether domain is a name with at least two labels, which
+// skips entries such as "localhost" of hosts files. Names with a numeric
+// top-level label, such as IPv4 addresses, are not valid.
+func valid(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	if strings.Trim(domain[strings.LastIndexByte(domain, '.')+1:], "0123456789") == "" {
+		return false
+	}
+	labelLen := 0
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		switch {
+		case c == '.':
+			if labelLen == 0 {
+				return false
+			}
+			labelLen = 0
+			continue
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+		if labelLen++; labelLen > 63 {
+			return false
+		}
+	}
+	return labelLen > 0
+}
+
+// Build compiles the domains added, and empties the builder.
+func (b *Builder) Build() *List {
+	// Keys are consumed while compiling.
+	entries := b.entries
+	b.entries = nil
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	nodes, labels := count(entries)
+	c := &compiler{
+		nodes:  make([]node, 1, nodes),
+		labels: make([]byte, 0, labels),
+	}
+	c.fill(0, entries)
+	return &List{
+		labels: string(c.labels),
+		nodes:  c.nodes,
+		size:   c.size,
+	}
+}
+
+// count returns the number of nodes and the size of the labels of the trie
+// of sorted entries, so that they are allocated once.
+func count(entries []entry) (int, int) {
+	nodes, labels := 1, 0
+	prev := ""
+	for _, e := range entries {
+		// Labels shared with the previous key are already in the trie.
+		shared := 0
+		for i := 0; ; i++ {
+			if i == len(e.key) || i == len(prev) || e.key[i] != prev[i] {
+				if (i == len(e.key) || e.key[i] == 0) && (i == len(prev) || prev[i] == 0) {
+					shared = i
+				}
+				break
+			}
+			if e.key[i] == 0 {
+				shared = i
+			}
+		}
+		if rest := e.key[shared:]; rest != "" {
+			sep := strings.Count(rest, "\x00")
+			labels += len(rest) - sep
+			nodes += sep
+			if rest[0] != 0 {
+				nodes++
+			}
+		}
+		prev = e.key
+	}
+	return nodes, labels
+}
+
+type compiler struct {
+	nodes  []node
+	labels []byte
+	size   int
+}
+
+// fill adds the children of node n for sorted entries, whose keys are what
+// is left of them below n.
+func (c *compiler) fill(n uint32, entries []entry) {
+	i := 0
+	for ; i < len(entries) && entries[i].key == ""; i++ {
+		c.nodes[n].flags |= entries[i].flag
+	}
+	if c.nodes[n].flags&flagBlock != 0 {
+		c.size++
+	}
+	entries = entries[i:]
+	if len(entries) == 0 {
+		return
+	}
+
+	first := uint32(len(c.nodes))
+	for start := 0; start < len(entries); {
+		label := firstLabel(entries[start].key)
+		end := groupEnd(entries, start, label)
+		c.nodes = append(c.nodes, node{label: uint32(len(c.labels)), labelLen: uint8(len(label))})
+		c.labels = append(c.labels, label...)
+		start = end
+	}
+	c.nodes[n].children = first
+	c.nodes[n].count = uint32(len(c.nodes)) - first
+
+	child := first
+	for start := 0; start < len(entries); child++ {
+		label := firstLabel(entries[start].key)
+		end := groupEnd(entries, start, label)
+		for j := start; j < end; j++ {
+			entries[j].key = strings.TrimPrefix(entries[j].key[len(label):], "\x00")
+		}
+		c.fill(child, entries[start:end])
+		start = end
+	}
+}
+
+func firstLabel(key string) string {
+	if i := strings.IndexByte(key, 0); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+func groupEnd(entries []entry, start int, label string) int {
+	end := start + 1
+	for end < len(entries) && firstLabel(entries[end].key) == label {
+		end++
+	}
+	return end
+}
+
+// Load compiles the blocklist files and allowlist files, and the allowed
+// domains.
+func Load(blocklists, allowlists, allow []string) (*List, error) {
+	b := new(Builder)
+	for _, path := range blocklists {
+		if err := parseFile(path, b.Parse); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range allowlists {
+		if err := parseFile(path, b.ParseAllow); err != nil {
+			return nil, err
+		}
+	}
+	for _, domain := range allow {
+		b.Allow(domain)
+	}
+	return b.Build(), nil
+}
+
+func parseFile(path string, parse func(io.Reader) (int, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = parse(f)
+	return err
+}
@@ -0,0 +1,79 @@
+package blocklist
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	b := new(Builder)
+	n, err := b.Parse(strings.NewReader(`# hosts
+0.0.0.0 ads.example.com tracker.example.net # comment
+! adblock
+||doubleclick.net^
+||path.example.org^/ad
+@@||ok.doubleclick.net^
+*.wild.example.io
+Plain.Example.COM.
+a..b
+`))
+	if err != nil || n != 6 {
+		t.Fatalf("added %d, %v", n, err)
+	}
+	b.Allow("safe.ads.example.com")
+	l := b.Build()
+	for domain, blocked := range map[string]bool{
+		"ads.example.com":      true,
+		"x.ads.example.com":    true,
+		"example.com":          false,
+		"safe.ads.example.com": false,
+		"doubleclick.net":      true,
+		"ok.doubleclick.net":   false,
+		"a.ok.doubleclick.net": false,
+		"path.example.org":     false,
+		"x.wild.example.io":    true,
+		"PLAIN.example.com":    true,
+		"xtracker.example.net": false,
+	} {
+		if l.Blocked(domain) != blocked {
+			t.Errorf("%s: blocked %v", domain, !blocked)
+		}
+	}
+}
+
+// build returns a list of n domains under 5000 parents, so that the trie
+// shares labels like real lists.
+func build(n int) *List {
+	b := new(Builder)
+	for i := 0; i < n; i++ {
+		b.Block(fmt.Sprintf("ads%d.tracker%d.example%d.com", i, i%5000, i%97))
+	}
+	return b.Build()
+}
+
+// BenchmarkBuild1M builds a list of one million domains, heap-MB is the
+// memory the list keeps once built.
+func BenchmarkBuild1M(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		l := build(1000000)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/1e6, "heap-MB")
+		runtime.KeepAlive(l)
+	}
+}
+
+func BenchmarkBlocked(b *testing.B) {
+	l := build(1000000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Blocked("www.ads123.tracker123.example26.com")
+	}
+}
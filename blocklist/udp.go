@@ -0,0 +1,100 @@
+package blocklist
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// UDP handler that answers DNS queries for blocked domains with NXDOMAIN,
+// other packets are passed to the next handler.
+type udpHandler struct {
+	list *List
+	next core.UDPConnHandler
+}
+
+const (
+	dnsHeaderLength  = 12
+	dnsMaskQr        = uint8(0x80)
+	dnsMaskOpcode    = uint8(0x78)
+	dnsMaskRa        = uint8(0x80)
+	dnsMaskRcode     = uint8(0x0F)
+	dnsRcodeNXDomain = 3
+)
+
+func NewUDPHandler(list *List, next core.UDPConnHandler) core.UDPConnHandler {
+	return &udpHandler{list: list, next: next}
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return h.next.Connect(conn, target)
+}
+
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	name, end, err := parseQuery(data)
+	if err != nil || !h.list.Blocked(name) {
+		return h.next.ReceiveTo(conn, data, addr)
+	}
+	log.Debugf("blocked DNS query %s", name)
+	_, err = conn.WriteFrom(nxdomain(data[:end]), addr)
+	return err
+}
+
+// Close releases the session of conn in the next handler.
+func (h *udpHandler) Close(conn core.UDPConn) {
+	if closer, ok := h.next.(conntrack.UDPCloser); ok {
+		closer.Close(conn)
+	}
+}
+
+// parseQuery returns the name asked by a standard query with a single
+// question, and the offset following the question.
+func parseQuery(data []byte) (string, int, error) {
+	if len(data) < dnsHeaderLength {
+		return "", 0, errors.New("malformed DNS query")
+	}
+	if data[2]&dnsMaskQr != 0 || data[2]&dnsMaskOpcode != 0 || binary.BigEndian.Uint16(data[4:6]) != 1 {
+		return "", 0, errors.New("unsupported DNS query")
+	}
+	var labels []string
+	off := dnsHeaderLength
+	for {
+		if off >= len(data) {
+			return "", 0, errors.New("malformed DNS query")
+		}
+		n := int(data[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n&0xC0 != 0 || off+n > len(data) {
+			return "", 0, errors.New("malformed DNS query")
+		}
+		labels = append(labels, string(data[off:off+n]))
+		off += n
+	}
+	// Type and class.
+	if off+4 > len(data) {
+		return "", 0, errors.New("malformed DNS query")
+	}
+	return strings.Join(labels, "."), off + 4, nil
+}
+
+// nxdomain builds the NXDOMAIN response to the query made of the header
+// and question in query, additional records are dropped.
+func nxdomain(query []byte) []byte {
+	resp := make([]byte, len(query))
+	copy(resp, query)
+	resp[2] |= dnsMaskQr
+	resp[3] = (resp[3]|dnsMaskRa)&^dnsMaskRcode | dnsRcodeNXDomain
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	return resp
+}
@@ -0,0 +1,66 @@
+package conntrack
+
+import (
+	"net"
+	"strings"
+)
+
+// Filter selects flows, zero fields match any flow.
+type Filter struct {
+	ID uint64 `json:"id"`
+	// Process is the name of the owning process, case insensitive.
+	Process string `json:"process"`
+	// Destination is an IP, a domain or an address with a port, the
+	// peers of UDP flows match too.
+	Destination string `json:"destination"`
+}
+
+// IsZero reports whether the filter matches every flow.
+func (f Filter) IsZero() bool {
+	return f == Filter{}
+}
+
+func (f Filter) Match(c Conn) bool {
+	if f.ID != 0 && f.ID != c.ID {
+		return false
+	}
+	if f.Process != "" && !strings.EqualFold(f.Process, c.Process) {
+		return false
+	}
+	if f.Destination != "" && !matchDestination(f.Destination, c) {
+		return false
+	}
+	return true
+}
+
+func matchDestination(dest string, c Conn) bool {
+	if matchAddress(dest, c.Destination, c.Domain) {
+		return true
+	}
+	for _, peer := range c.Peers {
+		if matchAddress(dest, peer, "") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress reports whether dest is addr, its IP, or domain with or
+// without the port of addr.
+func matchAddress(dest, addr, domain string) bool {
+	if dest == addr || domain != "" && strings.EqualFold(dest, domain) {
+		return true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if ip := net.ParseIP(dest); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+	// A domain with a port.
+	if domain != "" {
+		return strings.EqualFold(dest, net.JoinHostPort(domain, port))
+	}
+	return false
+}
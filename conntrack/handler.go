@@ -0,0 +1,325 @@
+package conntrack
+
+import (
+	"container/heap"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// ErrBlocked is returned, possibly wrapped, by handlers refusing a
+// connection on purpose, it is not counted as an error.
+var ErrBlocked = errors.New("blocked")
+
+// ErrHalfCloseUnsupported is returned by CloseWrite and CloseRead of the
+// tracked conns when the conn they wrap can't be half closed.
+var ErrHalfCloseUnsupported = errors.New("half close not supported")
+
+// Flower is implemented by the conns given to the wrapped handlers, so that
+// they can add metadata to the flow.
+type Flower interface {
+	Flow() *Flow
+}
+
+// FlowOf returns the flow of conn, nil if it is not tracked.
+func FlowOf(conn interface{}) *Flow {
+	if c, ok := conn.(Flower); ok {
+		return c.Flow()
+	}
+	return nil
+}
+
+type tcpHandler struct {
+	handler core.TCPConnHandler
+	tracker *Tracker
+}
+
+// NewTCPHandler returns a TCP handler adding the connections to tracker
+// before passing them to handler.
+func NewTCPHandler(handler core.TCPConnHandler, tracker *Tracker) core.TCPConnHandler {
+	return &tcpHandler{handler: handler, tracker: tracker}
+}
+
+type tcpConn struct {
+	net.Conn
+
+	flow *Flow
+}
+
+func (c *tcpConn) Flow() *Flow {
+	return c.flow
+}
+
+func (c *tcpConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.flow.AddUpload(n)
+	}
+	return n, err
+}
+
+func (c *tcpConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.flow.AddDownload(n)
+	}
+	return n, err
+}
+
+func (c *tcpConn) Close() error {
+	c.flow.Close("closed")
+	return c.Conn.Close()
+}
+
+// NetConn returns the conn wrapped. Relays moving data around the tracked
+// conn count it on the flow themselves.
+func (c *tcpConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the write side of the conn, if supported.
+func (c *tcpConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrHalfCloseUnsupported
+}
+
+// CloseRead shuts down the read side of the conn, if supported.
+func (c *tcpConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return ErrHalfCloseUnsupported
+}
+
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	tc := &tcpConn{
+		Conn: conn,
+		flow: h.tracker.Add("tcp", conn.LocalAddr(), target),
+	}
+	// Handlers close their side once the local conn is closed.
+	tc.flow.setKill(func() { tc.Close() })
+	err := h.handler.Handle(tc, target)
+	if err != nil {
+		tc.flow.fail(err)
+	}
+	return err
+}
+
+// fail closes the flow of a connection the handler could not open.
+func (f *Flow) fail(err error) {
+	if errors.Is(err, ErrBlocked) {
+		f.Close("blocked")
+		return
+	}
+	f.tracker.countError(err)
+	f.Close(err.Error())
+}
+
+// Fail ends a TCP connection that a handler fails to open after its Handle
+// returned, as if Handle had returned err: the flow of conn is closed with
+// err and conn is reset.
+func Fail(conn net.Conn, err error) {
+	if tc, ok := conn.(*tcpConn); ok {
+		tc.flow.fail(err)
+		conn = tc.Conn
+	}
+	if a, ok := conn.(interface{ Abort() }); ok {
+		a.Abort()
+	} else {
+		conn.Close()
+	}
+}
+
+// UDPCloser is implemented by UDP handlers able to release a session
+// before it times out.
+type UDPCloser interface {
+	Close(conn core.UDPConn)
+}
+
+type udpHandler struct {
+	handler     core.UDPConnHandler
+	tracker     *Tracker
+	conns       *UDPTable
+	maxSessions int
+	// evicting serializes evictions, so that a burst of new sessions
+	// past the maximum evicts once.
+	evicting sync.Mutex
+}
+
+// NewUDPHandler returns a UDP handler adding the sessions to tracker before
+// passing them to handler. Past maxSessions sessions, the least recently
+// active ones are closed, zero is unlimited.
+func NewUDPHandler(handler core.UDPConnHandler, tracker *Tracker, maxSessions int) core.UDPConnHandler {
+	return &udpHandler{
+		handler:     handler,
+		tracker:     tracker,
+		conns:       NewUDPTable(),
+		maxSessions: maxSessions,
+	}
+}
+
+// udpConn is given to the handler in place of the conn from the core, so
+// that replies are counted and closing it can be noticed.
+type udpConn struct {
+	core.UDPConn
+
+	sync.Mutex
+	flow      *Flow
+	handler   *udpHandler
+	closeOnce sync.Once
+}
+
+func (c *udpConn) Flow() *Flow {
+	c.Lock()
+	defer c.Unlock()
+	return c.flow
+}
+
+// activeFlow returns the flow of the session, a new one is added if the
+// previous one was closed after being idle, as handlers such as the DNS
+// ones never close their sessions.
+func (c *udpConn) activeFlow(addr *net.UDPAddr) *Flow {
+	c.Lock()
+	defer c.Unlock()
+	if c.flow.Closed() {
+		c.flow = c.handler.newFlow(c, addr)
+	}
+	return c.flow
+}
+
+// kill releases the session in the handler, then closes the conn from the
+// core.
+func (c *udpConn) kill() {
+	if closer, ok := c.handler.handler.(UDPCloser); ok {
+		closer.Close(c)
+	}
+	c.Close()
+}
+
+func (c *udpConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	n, err := c.UDPConn.WriteFrom(data, addr)
+	if n > 0 {
+		c.Flow().AddDownload(n)
+	}
+	return n, err
+}
+
+// Close closes the conn from the core once, as the core would otherwise
+// drop a new session from the same source.
+func (c *udpConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.handler.remove(c.UDPConn, "closed")
+		err = c.UDPConn.Close()
+	})
+	return err
+}
+
+func (h *udpHandler) newFlow(c *udpConn, addr *net.UDPAddr) *Flow {
+	var dst net.Addr
+	if addr != nil {
+		dst = addr
+	}
+	f := h.tracker.Add("udp", c.UDPConn.LocalAddr(), dst)
+	f.setKill(c.kill)
+	return f
+}
+
+func (h *udpHandler) remove(conn core.UDPConn, reason string) {
+	if uc, ok := h.conns.LoadAndDelete(conn); ok {
+		uc.(*udpConn).Flow().Close(reason)
+	}
+}
+
+// idleSession is a session and the time it was last active.
+type idleSession struct {
+	conn       *udpConn
+	lastActive time.Time
+}
+
+// idleSessions is a heap of sessions, the most recently active first.
+type idleSessions []idleSession
+
+func (s idleSessions) Len() int            { return len(s) }
+func (s idleSessions) Less(i, j int) bool  { return s[i].lastActive.After(s[j].lastActive) }
+func (s idleSessions) Swap(i, j int)       { s[i], s[j] = s[j], s[i] }
+func (s *idleSessions) Push(x interface{}) { *s = append(*s, x.(idleSession)) }
+func (s *idleSessions) Pop() interface{} {
+	old := *s
+	x := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return x
+}
+
+// evict closes the least recently active sessions, a 64th of the maximum
+// at once so that a burst of new sessions doesn't scan the table each time.
+// Only these sessions are kept while scanning, in a heap.
+func (h *udpHandler) evict() {
+	h.evicting.Lock()
+	defer h.evicting.Unlock()
+
+	// Another Connect may have evicted while this one waited.
+	total := h.conns.Len()
+	if total < h.maxSessions {
+		return
+	}
+	n := h.maxSessions / 64
+	if n < 1 {
+		n = 1
+	}
+	oldest := make(idleSessions, 0, n)
+	h.conns.Range(func(conn core.UDPConn, v interface{}) {
+		uc := v.(*udpConn)
+		s := idleSession{uc, uc.Flow().LastActive()}
+		if len(oldest) < n {
+			heap.Push(&oldest, s)
+		} else if s.lastActive.Before(oldest[0].lastActive) {
+			oldest[0] = s
+			heap.Fix(&oldest, 0)
+		}
+	})
+	log.Infof("%d udp sessions, closing the %d least recently active", total, len(oldest))
+	for _, s := range oldest {
+		s.conn.Flow().SetCloseReason("evicted")
+		s.conn.kill()
+	}
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	if h.maxSessions > 0 && h.conns.Len() >= h.maxSessions {
+		h.evict()
+	}
+	uc := &udpConn{
+		UDPConn: conn,
+		handler: h,
+	}
+	uc.flow = h.newFlow(uc, target)
+	h.conns.Store(conn, uc)
+
+	err := h.handler.Connect(uc, target)
+	if errors.Is(err, ErrBlocked) {
+		h.remove(conn, "blocked")
+	} else if err != nil {
+		h.tracker.countError(err)
+		h.remove(conn, err.Error())
+	}
+	return err
+}
+
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	v, ok := h.conns.Load(conn)
+	if !ok {
+		return h.handler.ReceiveTo(conn, data, addr)
+	}
+	uc := v.(*udpConn)
+	f := uc.activeFlow(addr)
+	f.AddUpload(len(data))
+	f.addPeer(addr)
+	return h.handler.ReceiveTo(uc, data, addr)
+}
@@ -0,0 +1,108 @@
+package conntrack
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// evictConn is a UDP session from the core counting how often it is closed.
+type evictConn struct {
+	addr   *net.UDPAddr
+	mu     sync.Mutex
+	closed int
+}
+
+func (c *evictConn) LocalAddr() *net.UDPAddr                        { return c.addr }
+func (c *evictConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+func (c *evictConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	return len(data), nil
+}
+func (c *evictConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed++
+	return nil
+}
+
+// closingUDP records the sessions it is asked to release.
+type closingUDP struct {
+	mu     sync.Mutex
+	closed map[core.UDPConn]bool
+}
+
+func (h *closingUDP) Connect(conn core.UDPConn, target *net.UDPAddr) error              { return nil }
+func (h *closingUDP) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error { return nil }
+func (h *closingUDP) Close(conn core.UDPConn) {
+	h.mu.Lock()
+	h.closed[conn] = true
+	h.mu.Unlock()
+}
+
+// Past the maximum, the least recently active sessions are closed.
+func TestEvict(t *testing.T) {
+	tr := NewTracker(time.Minute, &UDPTimeouts{Default: time.Hour})
+	in := &closingUDP{closed: map[core.UDPConn]bool{}}
+	h := NewUDPHandler(in, tr, 128).(*udpHandler)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 9}
+	conns := make([]*evictConn, 128)
+	for i := range conns {
+		conns[i] = &evictConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000 + i}}
+		h.Connect(conns[i], target)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// All but sessions 0 and 1 are active again.
+	for i := 2; i < len(conns); i++ {
+		h.ReceiveTo(conns[i], []byte("x"), target)
+	}
+	extra := &evictConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}}
+	if err := h.Connect(extra, target); err != nil {
+		t.Fatal(err)
+	}
+	if h.conns.Len() != 127 {
+		t.Fatalf("%d sessions left", h.conns.Len())
+	}
+	if conns[0].closed != 1 || conns[1].closed != 1 || conns[2].closed != 0 {
+		t.Fatalf("sessions closed %d, %d and %d times", conns[0].closed, conns[1].closed, conns[2].closed)
+	}
+	if len(in.closed) != 2 {
+		t.Fatalf("%d sessions released", len(in.closed))
+	}
+	reasons := 0
+	for _, f := range tr.Closed() {
+		if f.Snapshot().CloseReason == "evicted" {
+			reasons++
+		}
+	}
+	if reasons != 2 {
+		t.Fatalf("%d flows evicted", reasons)
+	}
+}
+
+// Concurrent sessions past the maximum evict without piling up. Run with
+// -race.
+func TestEvictConcurrent(t *testing.T) {
+	tr := NewTracker(time.Minute, &UDPTimeouts{Default: time.Hour})
+	in := &closingUDP{closed: map[core.UDPConn]bool{}}
+	h := NewUDPHandler(in, tr, 256).(*udpHandler)
+	target := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 9}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				c := &evictConn{addr: &net.UDPAddr{IP: net.IPv4(10, 1, byte(w), 1), Port: 1000 + i}}
+				h.Connect(c, target)
+				h.ReceiveTo(c, []byte("x"), target)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if n := h.conns.Len(); n > 256+8 {
+		t.Fatalf("%d sessions", n)
+	}
+}
@@ -0,0 +1,104 @@
+package conntrack
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// A UDPTable has 2^udpTableShardBits shards.
+const (
+	udpTableShardBits = 6
+	udpTableShards    = 1 << udpTableShardBits
+)
+
+// UDPTable maps UDP sessions to values. It is split in shards by the local
+// address of the sessions, which is unique per session, so that sessions
+// don't contend on a single lock.
+type UDPTable struct {
+	len    int64 // accessed atomically
+	shards [udpTableShards]udpTableShard
+}
+
+type udpTableShard struct {
+	sync.RWMutex
+	m map[core.UDPConn]interface{}
+}
+
+func NewUDPTable() *UDPTable {
+	t := new(UDPTable)
+	for i := range t.shards {
+		t.shards[i].m = make(map[core.UDPConn]interface{})
+	}
+	return t
+}
+
+func (t *UDPTable) shard(conn core.UDPConn) *udpTableShard {
+	// FNV-1a of the local address, the top bits of which are spread by a
+	// Fibonacci hash.
+	h := uint64(14695981039346656037)
+	if addr := conn.LocalAddr(); addr != nil {
+		ip := addr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, b := range ip {
+			h = (h ^ uint64(b)) * 1099511628211
+		}
+		h = (h ^ uint64(addr.Port&0xff)) * 1099511628211
+		h = (h ^ uint64(addr.Port>>8)) * 1099511628211
+	}
+	return &t.shards[(h*0x9e3779b97f4a7c15)>>(64-udpTableShardBits)]
+}
+
+// Load returns the value of conn.
+func (t *UDPTable) Load(conn core.UDPConn) (interface{}, bool) {
+	s := t.shard(conn)
+	s.RLock()
+	v, ok := s.m[conn]
+	s.RUnlock()
+	return v, ok
+}
+
+// Store sets the value of conn.
+func (t *UDPTable) Store(conn core.UDPConn, v interface{}) {
+	s := t.shard(conn)
+	s.Lock()
+	if _, ok := s.m[conn]; !ok {
+		atomic.AddInt64(&t.len, 1)
+	}
+	s.m[conn] = v
+	s.Unlock()
+}
+
+// LoadAndDelete removes conn, and returns its value if it was there.
+func (t *UDPTable) LoadAndDelete(conn core.UDPConn) (interface{}, bool) {
+	s := t.shard(conn)
+	s.Lock()
+	v, ok := s.m[conn]
+	if ok {
+		delete(s.m, conn)
+		atomic.AddInt64(&t.len, -1)
+	}
+	s.Unlock()
+	return v, ok
+}
+
+// Len returns the number of sessions.
+func (t *UDPTable) Len() int {
+	return int(atomic.LoadInt64(&t.len))
+}
+
+// Range calls fn for each session, one shard at a time. fn must not change
+// the table.
+func (t *UDPTable) Range(fn func(conn core.UDPConn, v interface{})) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.RLock()
+		for conn, v := range s.m {
+			fn(conn, v)
+		}
+		s.RUnlock()
+	}
+}
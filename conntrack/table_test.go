@@ -0,0 +1,136 @@
+package conntrack
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// keyConn is a UDP session only used as a table key.
+type keyConn struct{ addr *net.UDPAddr }
+
+func (c *keyConn) LocalAddr() *net.UDPAddr                        { return c.addr }
+func (c *keyConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+func (c *keyConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	return len(data), nil
+}
+func (c *keyConn) Close() error { return nil }
+
+func keyConns(n int) []core.UDPConn {
+	conns := make([]core.UDPConn, n)
+	for i := range conns {
+		conns[i] = &keyConn{&net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1024 + i%60000}}
+	}
+	return conns
+}
+
+// Sessions are stored, loaded, deleted and ranged over concurrently, run
+// with -race.
+func TestUDPTableConcurrent(t *testing.T) {
+	const workers = 16
+	table := NewUDPTable()
+	conns := keyConns(4096)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(conns); i += workers {
+				table.Store(conns[i], i)
+				for r := 0; r < 8; r++ {
+					table.Load(conns[(i+r*31)%len(conns)])
+				}
+				if v, ok := table.Load(conns[i]); !ok || v.(int) != i {
+					t.Errorf("load %d: got %v, %v", i, v, ok)
+				}
+				if i%2 == 0 {
+					if _, ok := table.LoadAndDelete(conns[i]); !ok {
+						t.Errorf("delete %d: not found", i)
+					}
+				}
+				if i%256 == w {
+					table.Range(func(conn core.UDPConn, v interface{}) {
+						if conn.(*keyConn) != conns[v.(int)] {
+							t.Errorf("range: %v stored for %v", v, conn.LocalAddr())
+						}
+					})
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if n := table.Len(); n != len(conns)/2 {
+		t.Fatalf("len %d, want %d", n, len(conns)/2)
+	}
+	n := 0
+	table.Range(func(conn core.UDPConn, v interface{}) {
+		if v.(int)%2 == 0 {
+			t.Errorf("deleted session %d ranged over", v)
+		}
+		n++
+	})
+	if n != len(conns)/2 {
+		t.Fatalf("ranged over %d sessions, want %d", n, len(conns)/2)
+	}
+	used := 0
+	for i := range table.shards {
+		if len(table.shards[i].m) > 0 {
+			used++
+		}
+	}
+	if used < udpTableShards/2 {
+		t.Fatalf("only %d shards used", used)
+	}
+}
+
+// mutexTable is a map behind a single mutex, what the handlers used before
+// the table.
+type mutexTable struct {
+	sync.Mutex
+	m map[core.UDPConn]interface{}
+}
+
+// benchTable looks up 4096 sessions from parallel goroutines, with one
+// session replaced every 64 lookups.
+func benchTable(b *testing.B, load func(core.UDPConn), store func(core.UDPConn), del func(core.UDPConn)) {
+	conns := keyConns(4096)
+	for _, c := range conns {
+		store(c)
+	}
+	var next int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddInt64(&next, 1)) * 977
+		for pb.Next() {
+			i++
+			c := conns[i%len(conns)]
+			if i%64 == 0 {
+				del(c)
+				store(c)
+			} else {
+				load(c)
+			}
+		}
+	})
+}
+
+func BenchmarkUDPTable(b *testing.B) {
+	table := NewUDPTable()
+	benchTable(b,
+		func(c core.UDPConn) { table.Load(c) },
+		func(c core.UDPConn) { table.Store(c, c) },
+		func(c core.UDPConn) { table.LoadAndDelete(c) })
+}
+
+func BenchmarkMutexMap(b *testing.B) {
+	table := &mutexTable{m: make(map[core.UDPConn]interface{})}
+	benchTable(b,
+		func(c core.UDPConn) { table.Lock(); _ = table.m[c]; table.Unlock() },
+		func(c core.UDPConn) { table.Lock(); table.m[c] = c; table.Unlock() },
+		func(c core.UDPConn) { table.Lock(); delete(table.m, c); table.Unlock() })
+}
@@ -0,0 +1,94 @@
+package conntrack
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UDPTimeouts are the idle timeouts of UDP sessions by destination port.
+type UDPTimeouts struct {
+	// Default is the timeout of ports with no timeout of their own.
+	Default time.Duration
+
+	ports []portTimeout // narrowest ranges first
+}
+
+type portTimeout struct {
+	first, last int
+	timeout     time.Duration
+}
+
+// NewUDPTimeouts returns the timeouts of ports, keyed by port or port range
+// such as "27015-27030", and def for the other ports. The narrowest range
+// wins when ranges overlap.
+func NewUDPTimeouts(def time.Duration, ports map[string]time.Duration) (*UDPTimeouts, error) {
+	t := &UDPTimeouts{Default: def}
+	for s, timeout := range ports {
+		first, last, err := ParsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		if timeout <= 0 {
+			return nil, errors.New("invalid timeout of port " + s)
+		}
+		t.ports = append(t.ports, portTimeout{first, last, timeout})
+	}
+	sort.Slice(t.ports, func(i, j int) bool {
+		a, b := t.ports[i], t.ports[j]
+		if a.last-a.first != b.last-b.first {
+			return a.last-a.first < b.last-b.first
+		}
+		return a.first < b.first
+	})
+	return t, nil
+}
+
+// Timeout returns the idle timeout of sessions to port.
+func (t *UDPTimeouts) Timeout(port int) time.Duration {
+	for _, pt := range t.ports {
+		if port >= pt.first && port <= pt.last {
+			return pt.timeout
+		}
+	}
+	return t.Default
+}
+
+// ParsePortTimeouts parses a comma separated list of port=timeout pairs,
+// such as "53=10s,27015-27030=10m".
+func ParsePortTimeouts(s string) (map[string]time.Duration, error) {
+	ports := make(map[string]time.Duration)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid port timeout: " + item)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, errors.New("invalid port timeout: " + item)
+		}
+		ports[strings.TrimSpace(kv[0])] = timeout
+	}
+	return ports, nil
+}
+
+// ParsePortRange parses a port such as "53" or a range such as
+// "27015-27030".
+func ParsePortRange(s string) (int, int, error) {
+	s = strings.TrimSpace(s)
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	f, err1 := strconv.Atoi(strings.TrimSpace(first))
+	l, err2 := strconv.Atoi(strings.TrimSpace(last))
+	if err1 != nil || err2 != nil || f < 0 || l > 65535 || f > l {
+		return 0, 0, errors.New("invalid port: " + s)
+	}
+	return f, l, nil
+}
@@ -0,0 +1,509 @@
+// Package conntrack keeps a table of the connections going through tun2ray,
+// with metadata about each flow and byte counters.
+package conntrack
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn is a snapshot of a flow.
+type Conn struct {
+	ID          uint64    `json:"id"`
+	Network     string    `json:"network"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Domain      string    `json:"domain,omitempty"`
+	Process     string    `json:"process,omitempty"`
+	Route       string    `json:"route,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end,omitempty"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+	CloseReason string    `json:"closeReason,omitempty"`
+	// Peers are the other destinations a UDP session sent to, at most
+	// maxPeers.
+	Peers []string `json:"peers,omitempty"`
+}
+
+// maxPeers is how many destinations of a UDP flow are listed besides the
+// first one.
+const maxPeers = 32
+
+// Flow is a connection in the table.
+type Flow struct {
+	// Accessed atomically, first in the struct for 64-bit alignment.
+	upload      int64
+	download    int64
+	lastActive  int64 // unix nanoseconds
+	idleTimeout int64 // of UDP flows, in nanoseconds
+
+	// Counted by the previous Collect, guarded by the tracker lock.
+	collectedUpload   int64
+	collectedDownload int64
+	collected         bool
+
+	sync.Mutex
+	conn    Conn
+	dst     *net.UDPAddr   // first destination of UDP flows
+	peers   []*net.UDPAddr // other destinations of UDP flows
+	closed  bool
+	kill    func()
+	tracker *Tracker
+}
+
+// Tracker is the connection table. Closed flows are kept for the history
+// window, UDP flows idle for longer than their timeout are considered
+// closed, as some handlers never close them.
+type Tracker struct {
+	// Bytes of all flows, accessed atomically, first in the struct for
+	// 64-bit alignment.
+	upload   int64
+	download int64
+
+	sync.Mutex
+
+	nextID      uint64
+	active      map[uint64]*Flow
+	closed      []*Flow // ordered by end time
+	history     time.Duration
+	udpTimeouts *UDPTimeouts
+
+	// Closed flows not seen by Collect yet, only kept once Collect has
+	// been called.
+	collecting bool
+	pending    []*Flow
+
+	totalsMu sync.Mutex
+	opened   map[RouteKey]int64
+	errors   map[string]int64
+}
+
+// RouteKey identifies flows by network and route.
+type RouteKey struct {
+	Network string
+	Route   string
+}
+
+// Totals are counters over all flows since the tracker was created.
+type Totals struct {
+	// Opened counts flows by network and route.
+	Opened map[RouteKey]int64
+	// Errors counts flows handlers failed to open by reason.
+	Errors   map[string]int64
+	Upload   int64
+	Download int64
+}
+
+// NewTracker returns a tracker keeping closed flows for history, and
+// closing UDP flows idle for longer than udpTimeouts, which may be nil.
+func NewTracker(history time.Duration, udpTimeouts *UDPTimeouts) *Tracker {
+	return &Tracker{
+		active:      make(map[uint64]*Flow),
+		history:     history,
+		udpTimeouts: udpTimeouts,
+		opened:      make(map[RouteKey]int64),
+		errors:      make(map[string]int64),
+	}
+}
+
+// Totals returns a copy of the counters.
+func (t *Tracker) Totals() *Totals {
+	t.totalsMu.Lock()
+	defer t.totalsMu.Unlock()
+
+	totals := &Totals{
+		Opened:   make(map[RouteKey]int64, len(t.opened)),
+		Errors:   make(map[string]int64, len(t.errors)),
+		Upload:   atomic.LoadInt64(&t.upload),
+		Download: atomic.LoadInt64(&t.download),
+	}
+	for k, v := range t.opened {
+		totals.Opened[k] = v
+	}
+	for k, v := range t.errors {
+		totals.Errors[k] = v
+	}
+	return totals
+}
+
+func (t *Tracker) countOpened(network, route string) {
+	t.totalsMu.Lock()
+	defer t.totalsMu.Unlock()
+	t.opened[RouteKey{network, route}]++
+}
+
+func (t *Tracker) countError(err error) {
+	t.totalsMu.Lock()
+	defer t.totalsMu.Unlock()
+	t.errors[errorReason(err)]++
+}
+
+// errorReason classifies errors of handlers failing to open a flow.
+func errorReason(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "refused"):
+		return "refused"
+	case strings.Contains(msg, "unreachable"):
+		return "unreachable"
+	case strings.Contains(msg, "no such host"):
+		return "dns"
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return "timeout"
+	case strings.Contains(msg, "reset"):
+		return "reset"
+	}
+	return "other"
+}
+
+// Add adds a new flow from src to dst, dst may be nil.
+func (t *Tracker) Add(network string, src, dst net.Addr) *Flow {
+	now := time.Now()
+	f := &Flow{
+		lastActive: now.UnixNano(),
+		conn: Conn{
+			Network: network,
+			Source:  src.String(),
+			Start:   now,
+		},
+		tracker: t,
+	}
+	if dst != nil {
+		f.conn.Destination = dst.String()
+		f.dst, _ = dst.(*net.UDPAddr)
+	}
+	if network == "udp" && t.udpTimeouts != nil {
+		port := 0
+		if addr, ok := dst.(*net.UDPAddr); ok {
+			port = addr.Port
+		}
+		f.idleTimeout = int64(t.udpTimeouts.Timeout(port))
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.nextID++
+	f.conn.ID = t.nextID
+	t.active[f.conn.ID] = f
+	return f
+}
+
+// Get returns the flow with id, active or in the history.
+func (t *Tracker) Get(id uint64) (*Flow, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.prune(time.Now())
+	if f, ok := t.active[id]; ok {
+		return f, true
+	}
+	for _, f := range t.closed {
+		if f.ID() == id {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// Active returns the active flows sorted by ID.
+func (t *Tracker) Active() []*Flow {
+	t.Lock()
+	defer t.Unlock()
+
+	t.prune(time.Now())
+	flows := make([]*Flow, 0, len(t.active))
+	for _, f := range t.active {
+		flows = append(flows, f)
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].ID() < flows[j].ID() })
+	return flows
+}
+
+// Closed returns the flows closed within the history window, the most
+// recently closed last.
+func (t *Tracker) Closed() []*Flow {
+	t.Lock()
+	defer t.Unlock()
+
+	t.prune(time.Now())
+	return append([]*Flow(nil), t.closed...)
+}
+
+// Kill closes the active flow with id, it reports whether it was found.
+func (t *Tracker) Kill(id uint64) bool {
+	t.Lock()
+	f, ok := t.active[id]
+	t.Unlock()
+	if !ok {
+		return false
+	}
+	f.Kill()
+	return true
+}
+
+// KillMatching closes the active flows matching filter and returns their
+// IDs.
+func (t *Tracker) KillMatching(filter Filter) []uint64 {
+	var ids []uint64
+	for _, f := range t.Active() {
+		if filter.Match(f.Snapshot()) {
+			f.Kill()
+			ids = append(ids, f.ID())
+		}
+	}
+	return ids
+}
+
+// Snapshot returns a copy of flows.
+func Snapshot(flows []*Flow) []Conn {
+	conns := make([]Conn, len(flows))
+	for i, f := range flows {
+		conns[i] = f.Snapshot()
+	}
+	return conns
+}
+
+// prune closes idle UDP flows and drops flows out of the history window.
+// It must be called with the lock held.
+func (t *Tracker) prune(now time.Time) {
+	for _, f := range t.active {
+		timeout := time.Duration(atomic.LoadInt64(&f.idleTimeout))
+		if timeout > 0 && now.Sub(f.LastActive()) > timeout {
+			if f.finish("idle timeout", now) {
+				t.moveToClosed(f)
+			}
+		}
+	}
+	i := 0
+	for ; i < len(t.closed); i++ {
+		if now.Sub(t.closed[i].End()) <= t.history {
+			break
+		}
+	}
+	t.closed = t.closed[i:]
+}
+
+func (t *Tracker) moveToClosed(f *Flow) {
+	delete(t.active, f.conn.ID)
+	if t.history > 0 {
+		t.closed = append(t.closed, f)
+	}
+	if t.collecting {
+		t.pending = append(t.pending, f)
+	}
+}
+
+// Collect calls fn with the bytes counted on each flow since the previous
+// call, isNew is true the first time a flow is seen. Closed flows are only
+// kept for Collect once it has been called, so accounting calls it when it
+// starts, flows closed before the first call are not seen.
+func (t *Tracker) Collect(fn func(c Conn, upload, download int64, isNew bool)) {
+	t.Lock()
+	t.collecting = true
+	t.prune(time.Now())
+	flows := t.pending
+	t.pending = nil
+	for _, f := range t.active {
+		flows = append(flows, f)
+	}
+	type delta struct {
+		f                *Flow
+		upload, download int64
+		isNew            bool
+	}
+	deltas := make([]delta, 0, len(flows))
+	for _, f := range flows {
+		// Wait for the handlers to route new flows.
+		if !f.collected && !f.Closed() && f.Route() == "" {
+			continue
+		}
+		up := atomic.LoadInt64(&f.upload)
+		down := atomic.LoadInt64(&f.download)
+		d := delta{f, up - f.collectedUpload, down - f.collectedDownload, !f.collected}
+		f.collectedUpload, f.collectedDownload, f.collected = up, down, true
+		if d.upload != 0 || d.download != 0 || d.isNew {
+			deltas = append(deltas, d)
+		}
+	}
+	t.Unlock()
+
+	for _, d := range deltas {
+		fn(d.f.Snapshot(), d.upload, d.download, d.isNew)
+	}
+}
+
+func (f *Flow) ID() uint64 {
+	return f.conn.ID
+}
+
+// Snapshot returns a copy of the flow.
+func (f *Flow) Snapshot() Conn {
+	f.Lock()
+	defer f.Unlock()
+
+	c := f.conn
+	c.Upload = atomic.LoadInt64(&f.upload)
+	c.Download = atomic.LoadInt64(&f.download)
+	if len(f.peers) > 0 {
+		c.Peers = make([]string, len(f.peers))
+		for i, peer := range f.peers {
+			c.Peers[i] = peer.String()
+		}
+	}
+	return c
+}
+
+// addPeer adds addr to the destinations of the UDP flow, as a session can
+// send to several peers.
+func (f *Flow) addPeer(addr *net.UDPAddr) {
+	f.Lock()
+	defer f.Unlock()
+
+	if addr == nil || sameUDPAddr(f.dst, addr) || len(f.peers) >= maxPeers {
+		return
+	}
+	for _, peer := range f.peers {
+		if sameUDPAddr(peer, addr) {
+			return
+		}
+	}
+	f.peers = append(f.peers, &net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port})
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// End returns the time the flow was closed, zero if it is active.
+func (f *Flow) End() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.conn.End
+}
+
+func (f *Flow) SetDomain(domain string) {
+	f.Lock()
+	defer f.Unlock()
+	f.conn.Domain = domain
+}
+
+func (f *Flow) SetProcess(process string) {
+	f.Lock()
+	defer f.Unlock()
+	f.conn.Process = process
+}
+
+func (f *Flow) SetRoute(route string) {
+	f.Lock()
+	defer f.Unlock()
+	if f.conn.Route == "" {
+		f.tracker.countOpened(f.conn.Network, route)
+	}
+	f.conn.Route = route
+}
+
+// Route returns the route of the flow, empty if not routed yet.
+func (f *Flow) Route() string {
+	f.Lock()
+	defer f.Unlock()
+	return f.conn.Route
+}
+
+// SetCloseReason sets the reason reported when the flow is closed, the
+// first reason set wins.
+func (f *Flow) SetCloseReason(reason string) {
+	f.Lock()
+	defer f.Unlock()
+	if f.conn.CloseReason == "" {
+		f.conn.CloseReason = reason
+	}
+}
+
+// SetIdleTimeout sets how long the UDP flow can be idle before it is
+// considered closed, handlers call it when they time out the session
+// after another duration than the tracker.
+func (f *Flow) SetIdleTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&f.idleTimeout, int64(timeout))
+}
+
+// LastActive returns the time bytes were last counted on the flow.
+func (f *Flow) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&f.lastActive))
+}
+
+// AddUpload counts bytes sent by the local app.
+func (f *Flow) AddUpload(n int) {
+	atomic.AddInt64(&f.upload, int64(n))
+	atomic.AddInt64(&f.tracker.upload, int64(n))
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+}
+
+// AddDownload counts bytes received by the local app.
+func (f *Flow) AddDownload(n int) {
+	atomic.AddInt64(&f.download, int64(n))
+	atomic.AddInt64(&f.tracker.download, int64(n))
+	atomic.StoreInt64(&f.lastActive, time.Now().UnixNano())
+}
+
+// Close moves the flow to the history, reason is used if no close reason
+// was set before.
+func (f *Flow) Close(reason string) {
+	t := f.tracker
+	t.Lock()
+	defer t.Unlock()
+
+	if f.finish(reason, time.Now()) {
+		t.moveToClosed(f)
+	}
+}
+
+func (f *Flow) finish(reason string, now time.Time) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return false
+	}
+	f.closed = true
+	f.conn.End = now
+	if f.conn.CloseReason == "" {
+		f.conn.CloseReason = reason
+	}
+	return true
+}
+
+// Kill closes both sides of the flow.
+func (f *Flow) Kill() {
+	f.Lock()
+	kill := f.kill
+	f.Unlock()
+
+	f.SetCloseReason("killed")
+	if kill != nil {
+		kill()
+	} else {
+		f.Close("killed")
+	}
+}
+
+func (f *Flow) setKill(kill func()) {
+	f.Lock()
+	defer f.Unlock()
+	f.kill = kill
+}
+
+// Closed reports whether the flow is closed.
+func (f *Flow) Closed() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.closed
+}
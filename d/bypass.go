@@ -0,0 +1,81 @@
+package d
+
+import (
+	"net"
+)
+
+// PrivateNetworks are the loopback, private, link-local, shared address
+// space and multicast ranges, which are not meant to be proxied.
+var PrivateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Bypass sends connections direct by destination, whatever app owns them.
+// A connection is bypassed if its IP, its port or its domain is listed.
+type Bypass struct {
+	nets    []*net.IPNet
+	ports   []portRange
+	domains []string
+}
+
+// NewBypass parses lists of CIDRs or addresses, ports or port ranges such
+// as "8000-9000", and domains, which match their subdomains too.
+func NewBypass(cidrs, ports, domains []string) (*Bypass, error) {
+	b := new(Bypass)
+	for _, s := range cidrs {
+		ipNet, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		b.nets = append(b.nets, ipNet)
+	}
+	for _, s := range ports {
+		pr, err := parsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		b.ports = append(b.ports, pr)
+	}
+	for _, domain := range domains {
+		if domain = canonicalDomain(domain); domain != "" {
+			b.domains = append(b.domains, domain)
+		}
+	}
+	return b, nil
+}
+
+func (b *Bypass) hasDomains() bool {
+	return b != nil && len(b.domains) > 0
+}
+
+// Match reports whether m is bypassed, it never looks up the process.
+func (b *Bypass) Match(m *Metadata) bool {
+	if b == nil {
+		return false
+	}
+	if m.IP != nil {
+		for _, ipNet := range b.nets {
+			if ipNet.Contains(m.IP) {
+				return true
+			}
+		}
+	}
+	for _, pr := range b.ports {
+		if m.Port >= pr.first && m.Port <= pr.last {
+			return true
+		}
+	}
+	return matchDomain(b.domains, m.Domain)
+}
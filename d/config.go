@@ -0,0 +1,139 @@
+package d
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/zinoulink/tun2ray/blocklist"
+	"github.com/zinoulink/tun2ray/conntrack"
+)
+
+// FakeDNS maps fake IPs handed out by a fake DNS server back to domains.
+type FakeDNS interface {
+	DomainForIP(ip net.IP) (string, bool)
+}
+
+// Config holds the settings of the TCP and UDP handlers.
+type Config struct {
+	// Bypass sends connections direct by destination before anything
+	// else, may be nil.
+	Bypass *Bypass
+	// Blocklist blocks connections to its domains, known from fake DNS or
+	// sniffing, may be nil.
+	Blocklist *blocklist.List
+	// Rules decide the route of connections that are not bypassed or
+	// blocked, before Exceptions, may be nil.
+	Rules *Rules
+	// Exceptions decides the route of connections matching no rule, an
+	// exception app matching a rule follows the rule.
+	Exceptions *Exceptions
+	// Lookup finds the application owning a connection, may be nil.
+	Lookup ProcessLookup
+	// SendThrough is the local address direct connections are sent
+	// through, may be nil.
+	SendThrough net.Addr
+	// FakeDNS translates fake IPs of direct connections back to domains,
+	// may be nil.
+	FakeDNS FakeDNS
+	// UDPTimeouts are the idle timeouts of direct UDP sessions.
+	UDPTimeouts *conntrack.UDPTimeouts
+	// TCPHalfOpenTimeout is how long direct TCP connections closed by one
+	// side are kept open without data, zero waits forever.
+	TCPHalfOpenTimeout time.Duration
+	// Sniffing lists the protocols, among "http" and "tls", the first bytes
+	// of TCP connections are sniffed with for the domain, when routing
+	// depends on it.
+	Sniffing []string
+	// SniffTimeout is how long to wait for the first bytes, zero disables
+	// sniffing.
+	SniffTimeout time.Duration
+}
+
+// directTarget returns the address to dial for a direct connection to
+// target, which is the domain name if target is a fake IP.
+func (c *Config) directTarget(ip net.IP, port int) string {
+	if c.FakeDNS != nil {
+		if domain, ok := c.FakeDNS.DomainForIP(ip); ok {
+			return net.JoinHostPort(domain, strconv.Itoa(port))
+		}
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// metadata describes a connection from src to the IP and port of dst for
+// routing.
+func (c *Config) metadata(network string, src, dst net.Addr, ip net.IP, port int) *Metadata {
+	m := &Metadata{
+		Network: network,
+		Src:     src,
+		Dst:     dst,
+		IP:      ip,
+		Port:    port,
+		lookup:  c.Lookup,
+	}
+	if c.FakeDNS != nil && ip != nil {
+		m.Domain, _ = c.FakeDNS.DomainForIP(ip)
+	}
+	return m
+}
+
+// shouldSniff reports whether the domain of m must be sniffed: it is not
+// known yet, and rules, bypass domains or the blocklist could match it.
+func (c *Config) shouldSniff(m *Metadata) bool {
+	if len(c.Sniffing) == 0 || c.SniffTimeout <= 0 || m.Domain != "" {
+		return false
+	}
+	if !c.Bypass.hasDomains() && !c.Rules.HasDomains() && c.Blocklist.Len() == 0 {
+		return false
+	}
+	return !c.Bypass.Match(m)
+}
+
+// route returns direct for bypassed connections, block for the domains of
+// the blocklist, then the route of the first rule matching m, or the route
+// of the app owning the connection. The app is always looked up for blocked
+// connections, which are logged.
+func (c *Config) route(m *Metadata) Route {
+	if c.Bypass.Match(m) {
+		return Route{Action: ActionDirect}
+	}
+	if c.Blocklist.Blocked(m.Domain) {
+		m.Process()
+		return Route{Action: ActionBlock}
+	}
+	if c.Rules != nil {
+		if route, ok := c.Rules.Match(m); ok {
+			if route.Action == ActionBlock {
+				m.Process()
+			}
+			return route
+		}
+	}
+	return c.Exceptions.Route(m.Process())
+}
+
+// processName returns the name of the owner of the connection for logs, it
+// is not looked up if routing did not need it.
+func processName(m *Metadata) string {
+	if m.process == nil {
+		return "-"
+	}
+	return m.process.Name
+}
+
+// track records the owning process, the domain and the route of conn in its
+// flow, if the connection is tracked.
+func track(conn interface{}, m *Metadata, route Route) {
+	f := conntrack.FlowOf(conn)
+	if f == nil {
+		return
+	}
+	if m.process != nil {
+		f.SetProcess(m.process.Name)
+	}
+	f.SetRoute(route.String())
+	if m.Domain != "" {
+		f.SetDomain(m.Domain)
+	}
+}
@@ -0,0 +1,167 @@
+package d
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Exceptions routes connections by the application owning them. An
+// application is matched either by name or by UID, apps that match
+// none of the lists take the default route.
+type Exceptions struct {
+	sync.RWMutex
+
+	defaultRoute Route
+	direct       map[string]bool
+	proxy        map[string]bool
+	outbounds    map[string]string
+}
+
+func NewExceptions(defaultRoute Route) *Exceptions {
+	return &Exceptions{
+		defaultRoute: defaultRoute,
+		direct:       make(map[string]bool),
+		proxy:        make(map[string]bool),
+		outbounds:    make(map[string]string),
+	}
+}
+
+// NewAppExceptions sends apps direct and everything else to the proxy.
+func NewAppExceptions(apps []string) *Exceptions {
+	e := NewExceptions(Route{Action: ActionProxy})
+	e.SetDirect(apps)
+	return e
+}
+
+func toSet(apps []string) map[string]bool {
+	set := make(map[string]bool, len(apps))
+	for _, app := range apps {
+		if app = strings.TrimSpace(app); app != "" {
+			set[app] = true
+		}
+	}
+	return set
+}
+
+func fromSet(set map[string]bool) []string {
+	apps := make([]string, 0, len(set))
+	for app := range set {
+		apps = append(apps, app)
+	}
+	return apps
+}
+
+// SetDirect replaces the list of apps that go direct.
+func (e *Exceptions) SetDirect(apps []string) {
+	e.Lock()
+	defer e.Unlock()
+	e.direct = toSet(apps)
+}
+
+// SetProxy replaces the list of apps that go to the proxy.
+func (e *Exceptions) SetProxy(apps []string) {
+	e.Lock()
+	defer e.Unlock()
+	e.proxy = toSet(apps)
+}
+
+// SetOutbounds replaces the app to outbound tag mapping, tags are parsed
+// with ParseRoute so that apps can be blocked too.
+func (e *Exceptions) SetOutbounds(outbounds map[string]string) {
+	e.Lock()
+	defer e.Unlock()
+	e.outbounds = make(map[string]string, len(outbounds))
+	for app, tag := range outbounds {
+		e.outbounds[app] = tag
+	}
+}
+
+// SetDefault sets the route of apps matching none of the lists.
+func (e *Exceptions) SetDefault(r Route) {
+	e.Lock()
+	defer e.Unlock()
+	e.defaultRoute = r
+}
+
+func (e *Exceptions) Direct() []string {
+	e.RLock()
+	defer e.RUnlock()
+	return fromSet(e.direct)
+}
+
+func (e *Exceptions) Proxy() []string {
+	e.RLock()
+	defer e.RUnlock()
+	return fromSet(e.proxy)
+}
+
+func (e *Exceptions) Outbounds() map[string]string {
+	e.RLock()
+	defer e.RUnlock()
+	outbounds := make(map[string]string, len(e.outbounds))
+	for app, tag := range e.outbounds {
+		outbounds[app] = tag
+	}
+	return outbounds
+}
+
+func (e *Exceptions) Default() Route {
+	e.RLock()
+	defer e.RUnlock()
+	return e.defaultRoute
+}
+
+// Route returns the route for connections owned by p. Outbound mappings
+// take precedence over the direct list, which takes precedence over the
+// proxy list.
+func (e *Exceptions) Route(p *Process) Route {
+	e.RLock()
+	defer e.RUnlock()
+
+	keys := []string{p.Name}
+	if p.UID >= 0 {
+		keys = append(keys, strconv.Itoa(p.UID))
+	}
+	for _, k := range keys {
+		if tag, ok := e.outbounds[k]; ok {
+			return ParseRoute(tag)
+		}
+	}
+	for _, k := range keys {
+		if e.direct[k] {
+			return Route{Action: ActionDirect}
+		}
+	}
+	for _, k := range keys {
+		if e.proxy[k] {
+			return Route{Action: ActionProxy}
+		}
+	}
+	return e.defaultRoute
+}
+
+// SplitList splits a comma separated list, ignoring empty items.
+func SplitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ParseOutbounds parses a comma separated list of app=tag pairs.
+func ParseOutbounds(s string) (map[string]string, error) {
+	outbounds := make(map[string]string)
+	for _, item := range SplitList(s) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, errors.New("invalid app outbound: " + item)
+		}
+		outbounds[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return outbounds, nil
+}
@@ -0,0 +1,123 @@
+package d
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Most bytes of ICMP errors, as recommended by RFC 1812 and RFC 4443.
+const (
+	maxICMPv4Size = 576
+	maxICMPv6Size = 1280
+)
+
+// rejectUDP tells the app that sent data from src to dst that the port is
+// unreachable, with an ICMP error written to the TUN device.
+func rejectUDP(src, dst *net.UDPAddr, data []byte) error {
+	pkt := portUnreachable(src, dst, data)
+	if pkt == nil {
+		return errors.New("invalid address")
+	}
+	_, err := core.OutputFn(pkt)
+	return err
+}
+
+// portUnreachable builds the ICMP or ICMPv6 port unreachable packet for
+// a UDP datagram from src to dst, quoting as much of it as fits.
+func portUnreachable(src, dst *net.UDPAddr, data []byte) []byte {
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		return portUnreachable4(src4, dst4, src.Port, dst.Port, data)
+	}
+	if src6, dst6 := src.IP.To16(), dst.IP.To16(); src6 != nil && dst6 != nil {
+		return portUnreachable6(src6, dst6, src.Port, dst.Port, data)
+	}
+	return nil
+}
+
+func portUnreachable4(src, dst net.IP, srcPort, dstPort int, data []byte) []byte {
+	// The datagram as sent by the app.
+	orig := make([]byte, 20+8+len(data))
+	ipv4Header(orig, src, dst, 17, len(orig))
+	udpHeader(orig[20:], srcPort, dstPort, 8+len(data))
+	copy(orig[28:], data)
+	if len(orig) > maxICMPv4Size-28 {
+		orig = orig[:maxICMPv4Size-28]
+	}
+
+	pkt := make([]byte, 20+8+len(orig))
+	ipv4Header(pkt, dst, src, 1, len(pkt))
+	icmp := pkt[20:]
+	icmp[0] = 3 // destination unreachable
+	icmp[1] = 3 // port unreachable
+	copy(icmp[8:], orig)
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, 0))
+	return pkt
+}
+
+func portUnreachable6(src, dst net.IP, srcPort, dstPort int, data []byte) []byte {
+	orig := make([]byte, 40+8+len(data))
+	ipv6Header(orig, src, dst, 17, 8+len(data))
+	udpHeader(orig[40:], srcPort, dstPort, 8+len(data))
+	copy(orig[48:], data)
+	if len(orig) > maxICMPv6Size-48 {
+		orig = orig[:maxICMPv6Size-48]
+	}
+
+	pkt := make([]byte, 40+8+len(orig))
+	ipv6Header(pkt, dst, src, 58, 8+len(orig))
+	icmp := pkt[40:]
+	icmp[0] = 1 // destination unreachable
+	icmp[1] = 4 // port unreachable
+	copy(icmp[8:], orig)
+	// The checksum covers the pseudo-header.
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pkt[i:]))
+	}
+	sum += uint32(len(icmp)) + 58
+	binary.BigEndian.PutUint16(icmp[2:], checksum(icmp, sum))
+	return pkt
+}
+
+func ipv4Header(b []byte, src, dst net.IP, protocol byte, totalLen int) {
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(totalLen))
+	b[8] = 64
+	b[9] = protocol
+	copy(b[12:16], src)
+	copy(b[16:20], dst)
+	binary.BigEndian.PutUint16(b[10:], checksum(b[:20], 0))
+}
+
+func ipv6Header(b []byte, src, dst net.IP, nextHeader byte, payloadLen int) {
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(payloadLen))
+	b[6] = nextHeader
+	b[7] = 64
+	copy(b[8:24], src)
+	copy(b[24:40], dst)
+}
+
+// udpHeader writes a UDP header without checksum, which is only quoted.
+func udpHeader(b []byte, srcPort, dstPort, length int) {
+	binary.BigEndian.PutUint16(b[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(b[4:], uint16(length))
+}
+
+// checksum returns the Internet checksum of b, added to sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
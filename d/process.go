@@ -0,0 +1,59 @@
+package d
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/zinoulink/tun2ray/lsof"
+	"github.com/zinoulink/tun2ray/metrics"
+)
+
+// Process describes the application owning a connection.
+type Process struct {
+	// Name is the process name on desktop systems, or the package
+	// name on Android.
+	Name string
+	// Path is the executable path, empty if unknown, always on Android
+	// where apps are known by their package.
+	Path string
+	// UID is the user ID owning the socket, -1 if unknown.
+	UID int
+}
+
+var unknownProcess = &Process{Name: "unknown process", UID: -1}
+
+// LookupLatency is the time spent finding the owner of connections, in
+// seconds.
+var LookupLatency = metrics.NewHistogram(.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1)
+
+// ProcessLookup finds the application owning a connection from src to dst.
+type ProcessLookup func(network string, src, dst net.Addr) (*Process, error)
+
+// LsofLookup finds the owning process by the local socket address, see
+// package lsof.
+func LsofLookup(network string, src, dst net.Addr) (*Process, error) {
+	host, portStr, err := net.SplitHostPort(src.String())
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(portStr)
+	name, path, err := lsof.GetProcessBySocket(network, host, uint16(port))
+	if err != nil {
+		return nil, err
+	}
+	return &Process{Name: name, Path: path, UID: -1}, nil
+}
+
+func lookupProcess(lookup ProcessLookup, network string, src, dst net.Addr) *Process {
+	if lookup == nil {
+		return unknownProcess
+	}
+	start := time.Now()
+	p, err := lookup(network, src, dst)
+	LookupLatency.ObserveSince(start)
+	if err != nil || p == nil {
+		return unknownProcess
+	}
+	return p
+}
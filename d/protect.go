@@ -0,0 +1,46 @@
+package d
+
+import (
+	"sync"
+	"syscall"
+)
+
+var (
+	controllersMu     sync.RWMutex
+	dialerControllers []func(network, address string, fd uintptr) error
+)
+
+// RegisterDialerController adds a function that is called on every socket
+// created for a direct connection, right before it is connected. It mirrors
+// internet.RegisterDialerController in V2Ray, and is typically used on Android
+// to exclude sockets from the VPN with VpnService.protect().
+func RegisterDialerController(ctl func(network, address string, fd uintptr) error) {
+	controllersMu.Lock()
+	defer controllersMu.Unlock()
+
+	dialerControllers = append(dialerControllers, ctl)
+}
+
+// control is meant to be used as the Control function of net.Dialer and
+// net.ListenConfig.
+func control(network, address string, c syscall.RawConn) error {
+	controllersMu.RLock()
+	defer controllersMu.RUnlock()
+
+	if len(dialerControllers) == 0 {
+		return nil
+	}
+
+	var ctlErr error
+	err := c.Control(func(fd uintptr) {
+		for _, ctl := range dialerControllers {
+			if ctlErr = ctl(network, address, fd); ctlErr != nil {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return ctlErr
+}
@@ -0,0 +1,90 @@
+package d
+
+import (
+	"net"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Action is what to do with a connection.
+type Action int
+
+const (
+	// ActionProxy hands the connection to the proxy handler.
+	ActionProxy Action = iota
+	// ActionDirect connects to the target directly, through sendThrough.
+	ActionDirect
+	// ActionOutbound hands the connection to the proxy handler, forcing the
+	// outbound with a specific tag.
+	ActionOutbound
+	// ActionBlock rejects the connection, TCP ones are reset.
+	ActionBlock
+	// ActionDrop discards the traffic of the connection without telling
+	// the app.
+	ActionDrop
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionProxy:
+		return "proxy"
+	case ActionDirect:
+		return "direct"
+	case ActionOutbound:
+		return "outbound"
+	case ActionBlock:
+		return "block"
+	case ActionDrop:
+		return "drop"
+	default:
+		return "unknown"
+	}
+}
+
+// Route is the routing decision made for a connection.
+type Route struct {
+	Action Action
+	// Tag is the outbound tag for ActionOutbound.
+	Tag string
+}
+
+func (r Route) String() string {
+	if r.Action == ActionOutbound {
+		return r.Tag
+	}
+	return r.Action.String()
+}
+
+// TaggedTCPConnHandler is a TCP handler able to send connections through
+// a named outbound.
+type TaggedTCPConnHandler interface {
+	core.TCPConnHandler
+
+	// HandleWithTag is like Handle, but uses the outbound tagged tag.
+	HandleWithTag(conn net.Conn, target *net.TCPAddr, tag string) error
+}
+
+// TaggedUDPConnHandler is a UDP handler able to send connections through
+// a named outbound.
+type TaggedUDPConnHandler interface {
+	core.UDPConnHandler
+
+	// ConnectWithTag is like Connect, but uses the outbound tagged tag.
+	ConnectWithTag(conn core.UDPConn, target *net.UDPAddr, tag string) error
+}
+
+// ParseRoute parses "proxy", "direct", "block", "drop", or an outbound tag.
+func ParseRoute(s string) Route {
+	switch s {
+	case "", "proxy":
+		return Route{Action: ActionProxy}
+	case "direct":
+		return Route{Action: ActionDirect}
+	case "block":
+		return Route{Action: ActionBlock}
+	case "drop":
+		return Route{Action: ActionDrop}
+	default:
+		return Route{Action: ActionOutbound, Tag: s}
+	}
+}
@@ -0,0 +1,363 @@
+package d
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RuleConfig is a rule as written in a rules file. A rule matches a
+// connection if every field that is set matches, lists match if any of
+// their items does.
+type RuleConfig struct {
+	// Process lists process names, package names on Android, or
+	// executable paths if they contain a path separator, which are
+	// only known on Windows and macOS.
+	Process StringList `json:"process,omitempty" yaml:"process,omitempty"`
+	// UID lists the user IDs owning the sockets.
+	UID []int `json:"uid,omitempty" yaml:"uid,omitempty"`
+	// CIDR lists destination ranges, e.g. "10.0.0.0/8", or addresses.
+	CIDR StringList `json:"cidr,omitempty" yaml:"cidr,omitempty"`
+	// Port lists destination ports or ranges, e.g. "8000-9000".
+	Port StringList `json:"port,omitempty" yaml:"port,omitempty"`
+	// Network is "tcp" or "udp".
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+	// Domain lists domains, matching their subdomains too. The domain of
+	// a connection is known from fake DNS or sniffing.
+	Domain StringList `json:"domain,omitempty" yaml:"domain,omitempty"`
+	// Action is "direct", "proxy", "block", "drop" or an outbound tag.
+	Action string `json:"action" yaml:"action"`
+}
+
+// RulesFile is the content of a rules file.
+type RulesFile struct {
+	Rules []RuleConfig `json:"rules" yaml:"rules"`
+}
+
+// StringList is a list of strings, which can be written as a single
+// string or number in rules files.
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(b []byte) error {
+	var items []interface{}
+	if err := json.Unmarshal(b, &items); err != nil {
+		var item interface{}
+		if err := json.Unmarshal(b, &item); err != nil {
+			return err
+		}
+		items = []interface{}{item}
+	}
+	return l.set(items)
+}
+
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items []interface{}
+	if err := unmarshal(&items); err != nil {
+		var item interface{}
+		if err := unmarshal(&item); err != nil {
+			return err
+		}
+		items = []interface{}{item}
+	}
+	return l.set(items)
+}
+
+func (l *StringList) set(items []interface{}) error {
+	*l = make(StringList, 0, len(items))
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			*l = append(*l, v)
+		case float64:
+			*l = append(*l, strconv.FormatFloat(v, 'f', -1, 64))
+		case int:
+			*l = append(*l, strconv.Itoa(v))
+		default:
+			return fmt.Errorf("invalid list item: %v", item)
+		}
+	}
+	return nil
+}
+
+type portRange struct {
+	first, last int
+}
+
+// rule is a parsed RuleConfig.
+type rule struct {
+	processes []string
+	uids      map[int]bool
+	nets      []*net.IPNet
+	ports     []portRange
+	network   string
+	domains   []string
+	route     Route
+}
+
+func parseRule(c RuleConfig) (*rule, error) {
+	if c.Action == "" {
+		return nil, errors.New("missing action")
+	}
+	r := &rule{
+		network: strings.ToLower(c.Network),
+		route:   ParseRoute(c.Action),
+	}
+	if r.network != "" && r.network != "tcp" && r.network != "udp" {
+		return nil, errors.New("invalid network: " + c.Network)
+	}
+	for _, p := range c.Process {
+		if p = strings.TrimSpace(p); p != "" {
+			r.processes = append(r.processes, p)
+		}
+	}
+	if len(c.UID) > 0 {
+		r.uids = make(map[int]bool, len(c.UID))
+		for _, uid := range c.UID {
+			r.uids[uid] = true
+		}
+	}
+	for _, s := range c.CIDR {
+		ipNet, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		r.nets = append(r.nets, ipNet)
+	}
+	for _, s := range c.Port {
+		pr, err := parsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		r.ports = append(r.ports, pr)
+	}
+	for _, domain := range c.Domain {
+		if domain = canonicalDomain(domain); domain != "" {
+			r.domains = append(r.domains, domain)
+		}
+	}
+	return r, nil
+}
+
+// parseCIDR parses a range, or a single address.
+func parseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid CIDR: " + s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errors.New("invalid CIDR: " + s)
+	}
+	return ipNet, nil
+}
+
+func parsePortRange(s string) (portRange, error) {
+	first, last, err := conntrack.ParsePortRange(s)
+	return portRange{first, last}, err
+}
+
+func canonicalDomain(domain string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+}
+
+// Metadata describes the connection being routed.
+type Metadata struct {
+	Network string
+	Src     net.Addr
+	Dst     net.Addr
+	IP      net.IP
+	Port    int
+	// Domain is the destination domain, empty if unknown.
+	Domain string
+
+	lookup  ProcessLookup
+	process *Process
+}
+
+// Process returns the owner of the connection, it is looked up the first
+// time, so that connections matched by rules that don't need it are not
+// attributed.
+func (m *Metadata) Process() *Process {
+	if m.process == nil {
+		m.process = lookupProcess(m.lookup, m.Network, m.Src, m.Dst)
+	}
+	return m.process
+}
+
+func (r *rule) match(m *Metadata) bool {
+	if r.network != "" && r.network != m.Network {
+		return false
+	}
+	if len(r.nets) > 0 && !r.matchIP(m.IP) {
+		return false
+	}
+	if len(r.ports) > 0 && !r.matchPort(m.Port) {
+		return false
+	}
+	if len(r.domains) > 0 && !matchDomain(r.domains, m.Domain) {
+		return false
+	}
+	if len(r.processes) > 0 && !r.matchProcess(m.Process()) {
+		return false
+	}
+	if r.uids != nil && !r.uids[m.Process().UID] {
+		return false
+	}
+	return true
+}
+
+func (r *rule) matchIP(ip net.IP) bool {
+	for _, ipNet := range r.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchPort(port int) bool {
+	for _, pr := range r.ports {
+		if port >= pr.first && port <= pr.last {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchProcess(p *Process) bool {
+	for _, name := range r.processes {
+		if strings.ContainsAny(name, `/\`) {
+			if p.Path != "" && strings.EqualFold(filepath.Clean(name), filepath.Clean(p.Path)) {
+				return true
+			}
+		} else if strings.EqualFold(name, p.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain reports whether domain is one of domains or a subdomain.
+func matchDomain(domains []string, domain string) bool {
+	if domain == "" {
+		return false
+	}
+	domain = canonicalDomain(domain)
+	for _, suffix := range domains {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules is an ordered list of rules, the first matching rule decides the
+// route of a connection. It can be replaced while running.
+type Rules struct {
+	sync.RWMutex
+
+	configs    []RuleConfig
+	rules      []*rule
+	hasDomains bool
+}
+
+// NewRules parses configs, see Set.
+func NewRules(configs []RuleConfig) (*Rules, error) {
+	r := new(Rules)
+	if err := r.Set(configs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Set replaces the rules, they are left unchanged if one is invalid.
+func (r *Rules) Set(configs []RuleConfig) error {
+	rules := make([]*rule, 0, len(configs))
+	hasDomains := false
+	for i, c := range configs {
+		parsed, err := parseRule(c)
+		if err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		rules = append(rules, parsed)
+		hasDomains = hasDomains || len(parsed.domains) > 0
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.configs = append([]RuleConfig(nil), configs...)
+	r.rules = rules
+	r.hasDomains = hasDomains
+	return nil
+}
+
+// HasDomains reports whether a rule matches domains, r may be nil.
+func (r *Rules) HasDomains() bool {
+	if r == nil {
+		return false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	return r.hasDomains
+}
+
+// Configs returns the rules as configured.
+func (r *Rules) Configs() []RuleConfig {
+	r.RLock()
+	defer r.RUnlock()
+	return append([]RuleConfig(nil), r.configs...)
+}
+
+// Match returns the route of the first rule matching m.
+func (r *Rules) Match(m *Metadata) (Route, bool) {
+	r.RLock()
+	rules := r.rules
+	r.RUnlock()
+
+	for _, rule := range rules {
+		if rule.match(m) {
+			return rule.route, true
+		}
+	}
+	return Route{}, false
+}
+
+// LoadRulesFile reads rules from a JSON file if its name ends with .json,
+// or from a YAML file. Unknown fields are errors in both, so that a
+// misspelled field does not turn a rule into a broader one.
+func LoadRulesFile(path string) ([]RuleConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f RulesFile
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	} else {
+		err = yaml.UnmarshalStrict(data, &f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %v", path, err)
+	}
+	return f.Rules, nil
+}
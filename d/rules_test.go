@@ -0,0 +1,44 @@
+package d
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRulesFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"rules.yaml": "rules:\n  - port: [443, \"8000-9000\"]\n    network: udp\n    action: block\n",
+		"rules.json": `{"rules": [{"port": [443, "8000-9000"], "network": "udp", "action": "block"}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rules, err := LoadRulesFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(rules) != 1 || len(rules[0].Port) != 2 || rules[0].Network != "udp" || rules[0].Action != "block" {
+			t.Fatalf("%s: got %+v", name, rules)
+		}
+	}
+}
+
+// A misspelled field is an error rather than a rule matching everything.
+func TestLoadRulesFileUnknownField(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"rules.yaml": "rules:\n  - ports: 443\n    action: block\n",
+		"rules.json": `{"rules": [{"ports": 443, "action": "block"}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if rules, err := LoadRulesFile(path); err == nil {
+			t.Errorf("%s: loaded %+v", name, rules)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package d
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+
+	vcommon "github.com/v2fly/v2ray-core/v4/common"
+	vhttp "github.com/v2fly/v2ray-core/v4/common/protocol/http"
+	vtls "github.com/v2fly/v2ray-core/v4/common/protocol/tls"
+)
+
+// sniffBufSize is the most bytes peeked, enough for TLS ClientHellos.
+const sniffBufSize = 4096
+
+var errNotSniffed = errors.New("no domain sniffed")
+
+type readResult struct {
+	n   int
+	err error
+}
+
+// sniffedConn replays the bytes peeked while sniffing before reading from
+// the conn.
+type sniffedConn struct {
+	net.Conn
+
+	buf []byte
+	err error
+	// pending is the read still running when sniffing timed out, it reads
+	// into the buffer right after buf.
+	pending <-chan readResult
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if c.pending != nil {
+		r := <-c.pending
+		c.pending = nil
+		c.buf = c.buf[:len(c.buf)+r.n]
+		c.err = r.err
+	}
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// Flow returns the flow of the conn, so that it is still tracked.
+func (c *sniffedConn) Flow() *conntrack.Flow {
+	return conntrack.FlowOf(c.Conn)
+}
+
+// CloseWrite shuts down the write side of the conn, if supported.
+func (c *sniffedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conntrack.ErrHalfCloseUnsupported
+}
+
+// CloseRead shuts down the read side of the conn, if supported.
+func (c *sniffedConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return conntrack.ErrHalfCloseUnsupported
+}
+
+// sniff reads the first bytes sent by the app, until the domain is found
+// with one of protocols or timeout. The tun2socks conns ignore deadlines,
+// so the read started last is left to the returned conn, which must be
+// used in place of conn.
+func sniff(conn net.Conn, protocols []string, timeout time.Duration) (string, net.Conn) {
+	c := &sniffedConn{Conn: conn}
+	buf := make([]byte, sniffBufSize)
+	results := make(chan readResult, 1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	n := 0
+	for {
+		go func(b []byte) {
+			n, err := conn.Read(b)
+			results <- readResult{n, err}
+		}(buf[n:])
+
+		select {
+		case r := <-results:
+			n += r.n
+			c.buf = buf[:n]
+			domain, err := sniffDomain(c.buf, protocols)
+			if r.err != nil || err != vcommon.ErrNoClue || n == len(buf) {
+				c.err = r.err
+				return domain, c
+			}
+		case <-timer.C:
+			c.buf = buf[:n]
+			c.pending = results
+			return "", c
+		}
+	}
+}
+
+// sniffDomain returns the TLS SNI or the HTTP host of b, it fails with
+// ErrNoClue if more bytes are needed.
+func sniffDomain(b []byte, protocols []string) (string, error) {
+	noClue := false
+	for _, protocol := range protocols {
+		var domain string
+		var err error
+		switch protocol {
+		case "tls":
+			var h *vtls.SniffHeader
+			if h, err = vtls.SniffTLS(b); err == nil {
+				domain = h.Domain()
+			}
+		case "http":
+			var h *vhttp.SniffHeader
+			if h, err = vhttp.SniffHTTP(b); err == nil {
+				domain = h.Domain()
+			} else if err == vcommon.ErrNoClue && bytes.Contains(b, []byte("\r\n\r\n")) {
+				// The headers are complete, without a host.
+				err = errNotSniffed
+			}
+		default:
+			continue
+		}
+		if err == nil {
+			if domain == "" || net.ParseIP(domain) != nil {
+				return "", errNotSniffed
+			}
+			return domain, nil
+		}
+		if err == vcommon.ErrNoClue {
+			noClue = true
+		}
+	}
+	if noClue {
+		return "", vcommon.ErrNoClue
+	}
+	return "", errNotSniffed
+}
@@ -0,0 +1,111 @@
+package d
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// recConn records what is written to it.
+type recConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recConn) Write(b []byte) (int, error) {
+	c.buf.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestSniffTLS(t *testing.T) {
+	a, b := net.Pipe()
+	rec := &recConn{Conn: b}
+	go tls.Client(rec, &tls.Config{ServerName: "www.example.com"}).Handshake()
+	domain, c := sniff(a, []string{"http", "tls"}, time.Second)
+	if domain != "www.example.com" {
+		t.Fatal("domain", domain)
+	}
+	got := make([]byte, rec.buf.Len())
+	if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, rec.buf.Bytes()) {
+		t.Fatal("replay", err)
+	}
+	a.Close()
+}
+
+// The host is found in headers sent in several segments.
+func TestSniffHTTPSplit(t *testing.T) {
+	a, b := net.Pipe()
+	req := "GET / HTTP/1.1\r\nHost: foo.example.org:8080\r\nUser-Agent: x\r\n\r\nbody"
+	go func() {
+		b.Write([]byte(req[:10]))
+		time.Sleep(10 * time.Millisecond)
+		b.Write([]byte(req[10:]))
+		b.Close()
+	}()
+	domain, c := sniff(a, []string{"http"}, time.Second)
+	if domain != "foo.example.org" {
+		t.Fatal("domain", domain)
+	}
+	got, _ := ioutil.ReadAll(c)
+	if string(got) != req {
+		t.Fatalf("replay %q", got)
+	}
+}
+
+// Bytes read after the timeout are still passed on.
+func TestSniffTimeout(t *testing.T) {
+	a, b := net.Pipe()
+	start := time.Now()
+	domain, c := sniff(a, []string{"http", "tls"}, 50*time.Millisecond)
+	if domain != "" || time.Since(start) > time.Second {
+		t.Fatal(domain)
+	}
+	go func() {
+		b.Write([]byte("SSH-2.0-x\r\n"))
+		b.Write([]byte("more"))
+		b.Close()
+	}()
+	got, _ := ioutil.ReadAll(c)
+	if string(got) != "SSH-2.0-x\r\nmore" {
+		t.Fatalf("%q", got)
+	}
+}
+
+// Sniffing gives up as soon as the bytes are of none of the protocols.
+func TestSniffNotProtocol(t *testing.T) {
+	a, b := net.Pipe()
+	go func() { b.Write([]byte("\x00\x01binary")); b.Close() }()
+	start := time.Now()
+	domain, c := sniff(a, []string{"http", "tls"}, time.Second)
+	if domain != "" || time.Since(start) > 500*time.Millisecond {
+		t.Fatal("slow or domain", domain)
+	}
+	got, _ := ioutil.ReadAll(c)
+	if string(got) != "\x00\x01binary" {
+		t.Fatalf("%q", got)
+	}
+	// HTTP without host stops at the end of the headers.
+	a, b = net.Pipe()
+	go func() { b.Write([]byte("GET / HTTP/1.0\r\n\r\n")) }()
+	start = time.Now()
+	if domain, _ := sniff(a, []string{"http"}, time.Second); domain != "" || time.Since(start) > 500*time.Millisecond {
+		t.Fatal("no host")
+	}
+}
+
+func TestShouldSniff(t *testing.T) {
+	rules, _ := NewRules([]RuleConfig{{Domain: StringList{"a.com"}, Action: "direct"}})
+	bypass, _ := NewBypass([]string{"10.0.0.0/8"}, nil, nil)
+	c := &Config{Rules: rules, Bypass: bypass, Sniffing: []string{"tls"}, SniffTimeout: time.Second}
+	if !c.shouldSniff(&Metadata{IP: net.ParseIP("1.1.1.1")}) || c.shouldSniff(&Metadata{IP: net.ParseIP("10.1.1.1")}) {
+		t.Fatal("sniffed bypassed connection, or not sniffed")
+	}
+	rules.Set(nil)
+	if c.shouldSniff(&Metadata{IP: net.ParseIP("1.1.1.1")}) {
+		t.Fatal("no domains")
+	}
+}
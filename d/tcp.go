@@ -1,13 +1,17 @@
 package d
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
-	"strconv"
+	"time"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+	"github.com/zinoulink/tun2ray/relay"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
-	"github.com/zinoulink/tun2ray/lsof"
 )
 
 // This handler allows you chain another proxy behind tun2socks locally, typically a rule-based proxy client, e.g. V2Ray.
@@ -32,65 +36,81 @@ import (
 // Optinally with all outbounds have sendThrough set to 192.168.1.189, if applicable.
 // https://v2ray.com/chapter_02/01_overview.html#outboundobject
 
+// dropTimeout is how long dropped connections are kept open.
+const dropTimeout = 2 * time.Minute
+
 type tcpHandler struct {
-	proxyHandler  core.TCPConnHandler
-	exceptionApps []string
-	sendThrough   net.Addr
+	proxyHandler core.TCPConnHandler
+	config       *Config
 }
 
-func NewTCPHandler(proxyHandler core.TCPConnHandler, exceptionApps []string, sendThrough net.Addr) core.TCPConnHandler {
+func NewTCPHandler(proxyHandler core.TCPConnHandler, config *Config) core.TCPConnHandler {
 	return &tcpHandler{
 		proxyHandler,
-		exceptionApps,
-		sendThrough,
+		config,
 	}
 }
 
-func (h *tcpHandler) isExceptionApp(name string) bool {
-	for _, app := range h.exceptionApps {
-		if name == app {
-			return true
-		}
-	}
-	return false
+// drop discards what the app sends until it gives up, or the drop timeout.
+func (h *tcpHandler) drop(conn net.Conn) {
+	timer := time.AfterFunc(dropTimeout, func() { conn.Close() })
+	defer timer.Stop()
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
 }
 
-func (h *tcpHandler) relay(lhs, rhs net.Conn) {
-	cls := func() {
-		rhs.Close()
-		lhs.Close()
+func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	m := h.config.metadata("tcp", conn.LocalAddr(), target, target.IP, target.Port)
+	if h.config.shouldSniff(m) {
+		// The core holds back what the app sends until Handle returns, so
+		// the connection is accepted first and routed once sniffed.
+		go func() {
+			var sniffed net.Conn
+			m.Domain, sniffed = sniff(conn, h.config.Sniffing, h.config.SniffTimeout)
+			if err := h.handle(sniffed, target, m); err != nil {
+				conntrack.Fail(conn, err)
+			}
+		}()
+		return nil
 	}
-
-	go func() {
-		io.Copy(rhs, lhs)
-		cls()
-	}()
-
-	io.Copy(lhs, rhs)
-	cls()
+	return h.handle(conn, target, m)
 }
 
-func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	localHost, localPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
-	localPortInt, _ := strconv.Atoi(localPortStr)
-	cmd, err := lsof.GetCommandNameBySocket("tcp", localHost, uint16(localPortInt))
-	if err != nil {
-		cmd = "unknown process"
-	}
+// handle routes conn with the metadata m.
+func (h *tcpHandler) handle(conn net.Conn, target *net.TCPAddr, m *Metadata) error {
+	route := h.config.route(m)
+	track(conn, m, route)
 
-	if h.isExceptionApp(cmd) {
-		dialer := net.Dialer{LocalAddr: h.sendThrough}
-		rc, err := dialer.Dial("tcp", target.String())
+	switch route.Action {
+	case ActionDirect:
+		dialer := net.Dialer{Control: control}
+		if h.config.SendThrough != nil {
+			dialer.LocalAddr = h.config.SendThrough
+		}
+		rc, err := dialer.Dial("tcp", h.config.directTarget(target.IP, target.Port))
 		if err != nil {
 			return err
 		}
 
-		go h.relay(conn, rc)
+		go relay.TCP(conn, rc, h.config.TCPHalfOpenTimeout)
 
-		log.Infof(cmd, "direct", target.Network(), conn.LocalAddr().String(), target.String())
+		log.Infof("%s: direct %s %s -> %s", processName(m), target.Network(), conn.LocalAddr().String(), target.String())
 
 		return nil
-	} else {
+	case ActionOutbound:
+		if th, ok := h.proxyHandler.(TaggedTCPConnHandler); ok {
+			return th.HandleWithTag(conn, target, route.Tag)
+		}
+		log.Warnf("%s: outbound %s is not supported by the proxy handler", processName(m), route.Tag)
+		return h.proxyHandler.Handle(conn, target)
+	case ActionBlock:
+		// The connection is reset by the core.
+		log.Infof("%s: blocked tcp %s -> %s", processName(m), conn.LocalAddr().String(), target.String())
+		return fmt.Errorf("%s: %w %s", processName(m), conntrack.ErrBlocked, target.String())
+	case ActionDrop:
+		go h.drop(conn)
+		return nil
+	default:
 		return h.proxyHandler.Handle(conn, target)
 	}
 }
@@ -0,0 +1,126 @@
+package d
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+)
+
+// coreConn is a TCP connection from the core, which can be reset.
+type coreConn struct {
+	net.Conn
+	aborted chan struct{}
+}
+
+func (c *coreConn) Abort() {
+	close(c.aborted)
+	c.Conn.Close()
+}
+
+// handledConn is a connection given to the proxy handler.
+type handledConn struct {
+	conn net.Conn
+	tag  string
+}
+
+// taggedHandler passes the connections it is given to conns.
+type taggedHandler struct {
+	conns chan handledConn
+}
+
+func (h *taggedHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	return h.HandleWithTag(conn, target, "")
+}
+
+func (h *taggedHandler) HandleWithTag(conn net.Conn, target *net.TCPAddr, tag string) error {
+	h.conns <- handledConn{conn, tag}
+	return nil
+}
+
+const request = "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+
+// sniffingHandler hands a connection to example.com to a handler sniffing
+// it and routing with rules, then sends a request for it.
+func sniffingHandler(t *testing.T, proxy *taggedHandler, rules ...RuleConfig) (*conntrack.Tracker, *coreConn) {
+	r, err := NewRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Rules:        r,
+		Exceptions:   NewExceptions(Route{Action: ActionProxy}),
+		Sniffing:     []string{"http", "tls"},
+		SniffTimeout: 10 * time.Second,
+	}
+	tracker := conntrack.NewTracker(time.Minute, nil)
+	h := conntrack.NewTCPHandler(NewTCPHandler(proxy, config), tracker)
+	target := &net.TCPAddr{IP: net.IPv4(93, 184, 216, 34), Port: 80}
+
+	app, conn := net.Pipe()
+	t.Cleanup(func() { app.Close() })
+	c := &coreConn{Conn: conn, aborted: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- h.Handle(c, target) }()
+
+	// The core only passes on what the app sends once Handle returned.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handle waits for the first bytes")
+	}
+	go app.Write([]byte(request))
+	return tracker, c
+}
+
+// Connections are routed with the domain sniffed after Handle returned, and
+// the proxy handler reads the sniffed bytes.
+func TestHandleSniffsAfterAccepting(t *testing.T) {
+	proxy := &taggedHandler{conns: make(chan handledConn, 1)}
+	sniffingHandler(t, proxy, RuleConfig{Domain: StringList{"example.com"}, Action: "jp"})
+
+	select {
+	case c := <-proxy.conns:
+		if c.tag != "jp" {
+			t.Fatalf("routed to %q", c.tag)
+		}
+		got := make([]byte, len(request))
+		if _, err := io.ReadFull(c.conn, got); err != nil || string(got) != request {
+			t.Fatalf("read %q, %v", got, err)
+		}
+		if f := conntrack.FlowOf(c.conn); f == nil || f.Snapshot().Domain != "www.example.com" {
+			t.Fatal("sniffed domain not tracked")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not handled")
+	}
+}
+
+// Connections failing once sniffed are reset and their flow closed, as if
+// Handle had failed.
+func TestHandleSniffedBlocked(t *testing.T) {
+	proxy := &taggedHandler{conns: make(chan handledConn, 1)}
+	tracker, c := sniffingHandler(t, proxy, RuleConfig{Domain: StringList{"example.com"}, Action: "block"})
+
+	select {
+	case <-c.aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not reset")
+	}
+	if len(tracker.Closed()) != 1 {
+		t.Fatal("flow not closed")
+	}
+	if reason := tracker.Closed()[0].Snapshot().CloseReason; reason != "blocked" {
+		t.Fatalf("closed as %q", reason)
+	}
+	select {
+	case c := <-proxy.conns:
+		t.Fatalf("blocked connection handled by %q", c.tag)
+	default:
+	}
+}
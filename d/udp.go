@@ -1,46 +1,74 @@
 package d
 
 import (
+	"context"
+	"fmt"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 
+	"github.com/zinoulink/tun2ray/conntrack"
+
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
-	"github.com/zinoulink/tun2ray/lsof"
 )
 
 type udpHandler struct {
-	sync.Mutex
+	proxyHandler core.UDPConnHandler
+	config       *Config
+	// conns holds the direct sessions as *exceptionConn and the dropped
+	// ones as *droppedConn, proxied sessions are not in it.
+	conns *conntrack.UDPTable
+}
 
-	proxyHandler   core.UDPConnHandler
-	exceptionApps  []string
-	sendThrough    net.Addr
-	exceptionConns map[core.UDPConn]*net.UDPConn
-	timeout        time.Duration
+// droppedConn is a blocked or dropped UDP session, kept until it is idle
+// so that its packets do not open new sessions.
+type droppedConn struct {
+	timer   *time.Timer
+	timeout time.Duration
+	// reject answers packets with ICMP port unreachable.
+	reject bool
 }
 
-func (h *udpHandler) isExceptionApp(name string) bool {
-	for _, app := range h.exceptionApps {
-		if name == app {
-			return true
-		}
-	}
-	return false
+// sessionQueueLen is how many packets of a direct session wait for its
+// socket, past it packets are dropped.
+const sessionQueueLen = 64
+
+// udpPacket is a packet of the app waiting to be sent, the first n bytes
+// of buf.
+type udpPacket struct {
+	buf  []byte
+	n    int
+	addr *net.UDPAddr
 }
 
-func NewUDPHandler(proxyHandler core.UDPConnHandler, exceptionApps []string, sendThrough net.Addr, timeout time.Duration) core.UDPConnHandler {
+// exceptionConn is a direct UDP session.
+type exceptionConn struct {
+	sync.Mutex
+
+	pc      *net.UDPConn
+	timeout time.Duration
+
+	// Real addresses of the fake IPs the session sent to, and the other
+	// way round to rewrite the source of replies.
+	realAddrs map[string]*net.UDPAddr
+	fakeAddrs map[string]*net.UDPAddr
+
+	// packets are sent by the writer of the session, so that neither
+	// the socket nor DNS holds up the lwIP thread.
+	packets chan udpPacket
+	done    chan struct{}
+}
+
+func NewUDPHandler(proxyHandler core.UDPConnHandler, config *Config) core.UDPConnHandler {
 	return &udpHandler{
-		proxyHandler:   proxyHandler,
-		exceptionApps:  exceptionApps,
-		sendThrough:    sendThrough,
-		exceptionConns: make(map[core.UDPConn]*net.UDPConn),
-		timeout:        timeout,
+		proxyHandler: proxyHandler,
+		config:       config,
+		conns:        conntrack.NewUDPTable(),
 	}
 }
 
-func (h *udpHandler) handleInput(conn core.UDPConn, pc *net.UDPConn) {
+func (h *udpHandler) handleInput(conn core.UDPConn, ec *exceptionConn) {
 	buf := core.NewBytes(core.BufSize)
 
 	defer func() {
@@ -49,12 +77,23 @@ func (h *udpHandler) handleInput(conn core.UDPConn, pc *net.UDPConn) {
 	}()
 
 	for {
-		pc.SetDeadline(time.Now().Add(h.timeout))
-		n, addr, err := pc.ReadFromUDP(buf)
+		ec.pc.SetDeadline(time.Now().Add(ec.timeout))
+		n, addr, err := ec.pc.ReadFromUDP(buf)
 		if err != nil {
+			if f := conntrack.FlowOf(conn); f != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					f.SetCloseReason("idle timeout")
+				}
+			}
 			return
 		}
 
+		ec.Lock()
+		if fake, ok := ec.fakeAddrs[addr.String()]; ok {
+			addr = fake
+		}
+		ec.Unlock()
+
 		_, err = conn.WriteFrom(buf[:n], addr)
 		if err != nil {
 			return
@@ -62,60 +101,181 @@ func (h *udpHandler) handleInput(conn core.UDPConn, pc *net.UDPConn) {
 	}
 }
 
-func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
-	localHost, localPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
-	localPortInt, _ := strconv.Atoi(localPortStr)
-	cmd, err := lsof.GetCommandNameBySocket("udp", localHost, uint16(localPortInt))
+// handleOutput sends the packets of the session until it is closed.
+func (h *udpHandler) handleOutput(conn core.UDPConn, ec *exceptionConn) {
+	for {
+		select {
+		case <-ec.done:
+			return
+		case p := <-ec.packets:
+			addr, err := ec.realAddr(h.config, p.addr)
+			if err == nil {
+				_, err = ec.pc.WriteTo(p.buf[:p.n], addr)
+			}
+			core.FreeBytes(p.buf)
+			if err != nil {
+				log.Debugf("direct udp %s -> %v failed: %v", conn.LocalAddr().String(), p.addr, err)
+			}
+		}
+	}
+}
+
+// realAddr returns the address to send to for addr, the real address if it
+// is a fake IP. The target of the session is resolved by Connect, other
+// fake IPs when the session first sends to them.
+func (ec *exceptionConn) realAddr(config *Config, addr *net.UDPAddr) (*net.UDPAddr, error) {
+	if config.FakeDNS == nil {
+		return addr, nil
+	}
+	if _, ok := config.FakeDNS.DomainForIP(addr.IP); !ok {
+		return addr, nil
+	}
+
+	ec.Lock()
+	real, ok := ec.realAddrs[addr.String()]
+	ec.Unlock()
+	if ok {
+		return real, nil
+	}
+	return ec.resolve(config, addr)
+}
+
+// resolve looks up the real address of the fake IP addr for the session.
+func (ec *exceptionConn) resolve(config *Config, addr *net.UDPAddr) (*net.UDPAddr, error) {
+	real, err := net.ResolveUDPAddr("udp", config.directTarget(addr.IP, addr.Port))
 	if err != nil {
-		cmd = "unknown process"
+		domain, _ := config.FakeDNS.DomainForIP(addr.IP)
+		return nil, fmt.Errorf("resolve %s failed: %v", domain, err)
 	}
 
-	if h.isExceptionApp(cmd) {
-		bindAddr, _ := net.ResolveUDPAddr(
-			"udp",
-			h.sendThrough.String(),
-		)
-		pc, err := net.ListenUDP("udp", bindAddr)
+	ec.Lock()
+	defer ec.Unlock()
+
+	ec.realAddrs[addr.String()] = real
+	ec.fakeAddrs[real.String()] = addr
+	return real, nil
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	var m *Metadata
+	if target != nil {
+		m = h.config.metadata("udp", conn.LocalAddr(), target, target.IP, target.Port)
+	} else {
+		m = h.config.metadata("udp", conn.LocalAddr(), nil, nil, 0)
+	}
+	route := h.config.route(m)
+	track(conn, m, route)
+	timeout := h.config.UDPTimeouts.Timeout(m.Port)
+
+	switch route.Action {
+	case ActionDirect:
+		bindAddr := ""
+		if h.config.SendThrough != nil {
+			bindAddr = h.config.SendThrough.String()
+		}
+		lc := net.ListenConfig{Control: control}
+		c, err := lc.ListenPacket(context.Background(), "udp", bindAddr)
 		if err != nil {
 			return err
 		}
-		h.Lock()
-		h.exceptionConns[conn] = pc
-		h.Unlock()
+		ec := &exceptionConn{
+			pc:        c.(*net.UDPConn),
+			timeout:   timeout,
+			realAddrs: make(map[string]*net.UDPAddr),
+			fakeAddrs: make(map[string]*net.UDPAddr),
+			packets:   make(chan udpPacket, sessionQueueLen),
+			done:      make(chan struct{}),
+		}
+		if target != nil && h.config.FakeDNS != nil {
+			if _, ok := h.config.FakeDNS.DomainForIP(target.IP); ok {
+				if _, err := ec.resolve(h.config, target); err != nil {
+					c.Close()
+					return err
+				}
+			}
+		}
+		h.conns.Store(conn, ec)
 
-		go h.handleInput(conn, pc)
+		go h.handleInput(conn, ec)
+		go h.handleOutput(conn, ec)
 
-		log.Infof(cmd, "direct", target.Network(), conn.LocalAddr().String(), target.String())
+		log.Infof("%s: direct udp %s -> %v", processName(m), conn.LocalAddr().String(), target)
 
 		return nil
-	} else {
+	case ActionOutbound:
+		if th, ok := h.proxyHandler.(TaggedUDPConnHandler); ok {
+			return th.ConnectWithTag(conn, target, route.Tag)
+		}
+		log.Warnf("%s: outbound %s is not supported by the proxy handler", processName(m), route.Tag)
+		return h.proxyHandler.Connect(conn, target)
+	case ActionBlock:
+		// Packets are rejected until the session is idle.
+		log.Infof("%s: blocked udp %s -> %v", processName(m), conn.LocalAddr().String(), target)
+		if f := conntrack.FlowOf(conn); f != nil {
+			f.SetCloseReason("blocked")
+		}
+		h.addDropped(conn, timeout, true)
+		return nil
+	case ActionDrop:
+		// Packets are discarded until the session is idle.
+		h.addDropped(conn, timeout, false)
+		return nil
+	default:
 		return h.proxyHandler.Connect(conn, target)
 	}
 }
 
-func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
-	h.Lock()
-	defer h.Unlock()
+func (h *udpHandler) addDropped(conn core.UDPConn, timeout time.Duration, reject bool) {
+	h.conns.Store(conn, &droppedConn{
+		timer:   time.AfterFunc(timeout, func() { h.Close(conn) }),
+		timeout: timeout,
+		reject:  reject,
+	})
+}
 
-	if pc, found := h.exceptionConns[conn]; found {
-		_, err := pc.WriteTo(data, addr)
-		if err != nil {
-			return err
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	c, _ := h.conns.Load(conn)
+	switch c := c.(type) {
+	case *droppedConn:
+		c.timer.Reset(c.timeout)
+		if c.reject {
+			if err := rejectUDP(conn.LocalAddr(), addr, data); err != nil {
+				log.Debugf("reject udp %s -> %v failed: %v", conn.LocalAddr().String(), addr, err)
+			}
 		}
 		return nil
-	} else {
+	case *exceptionConn:
+		// Queued for the writer of the session, data is only valid
+		// until ReceiveTo returns.
+		p := udpPacket{buf: core.NewBytes(len(data)), addr: addr}
+		p.n = copy(p.buf, data)
+		select {
+		case c.packets <- p:
+		default:
+			core.FreeBytes(p.buf)
+			log.Debugf("dropped direct udp %s -> %v, its socket is behind", conn.LocalAddr().String(), addr)
+		}
+		return nil
+	default:
 		return h.proxyHandler.ReceiveTo(conn, data, addr)
 	}
 }
 
+// Close releases the session of conn, in the proxy handler too if it is not
+// a direct or dropped one.
 func (h *udpHandler) Close(conn core.UDPConn) {
 	conn.Close()
 
-	h.Lock()
-	defer h.Unlock()
+	c, ok := h.conns.LoadAndDelete(conn)
+	switch c := c.(type) {
+	case *exceptionConn:
+		close(c.done)
+		c.pc.Close()
+	case *droppedConn:
+		c.timer.Stop()
+	}
 
-	if pc, ok := h.exceptionConns[conn]; ok {
-		pc.Close()
-		delete(h.exceptionConns, conn)
+	if closer, isCloser := h.proxyHandler.(conntrack.UDPCloser); !ok && isCloser {
+		closer.Close(conn)
 	}
 }
@@ -0,0 +1,210 @@
+package d
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+)
+
+// tableConn is a UDP session from the core counting its replies.
+type tableConn struct {
+	addr    *net.UDPAddr
+	replies int64
+	// sources receives the source of the replies if not nil.
+	sources chan string
+}
+
+func (c *tableConn) LocalAddr() *net.UDPAddr                        { return c.addr }
+func (c *tableConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+func (c *tableConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	atomic.AddInt64(&c.replies, 1)
+	if c.sources != nil {
+		c.sources <- addr.String()
+	}
+	return len(data), nil
+}
+func (c *tableConn) Close() error { return nil }
+
+// fakeDomains maps fake IPs to domains.
+type fakeDomains map[string]string
+
+func (f fakeDomains) DomainForIP(ip net.IP) (string, bool) {
+	domain, ok := f[ip.String()]
+	return domain, ok
+}
+
+// echoServer returns the address of a UDP server, echoing the packets it
+// reads if reply is set.
+func echoServer(t testing.TB, reply bool) *net.UDPAddr {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if reply {
+				pc.WriteToUDP(buf[:n], addr)
+			}
+		}
+	}()
+	if tt, ok := t.(interface{ Cleanup(func()) }); ok {
+		tt.Cleanup(func() { pc.Close() })
+	}
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+func newTableConn(i int) *tableConn {
+	return &tableConn{addr: &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 10000 + i%50000}}
+}
+
+// Thousands of direct sessions are opened, used and closed concurrently.
+// Run with -race.
+func TestUDPConcurrentSessions(t *testing.T) {
+	server := echoServer(t, true)
+	h := NewUDPHandler(nil, &Config{
+		Exceptions:  NewExceptions(Route{Action: ActionDirect}),
+		UDPTimeouts: &conntrack.UDPTimeouts{Default: 5 * time.Second},
+	}).(*udpHandler)
+
+	const flows = 2000
+	var wg sync.WaitGroup
+	conns := make([]*tableConn, flows)
+	for i := 0; i < flows; i++ {
+		conns[i] = newTableConn(i)
+		wg.Add(1)
+		go func(c *tableConn) {
+			defer wg.Done()
+			if err := h.Connect(c, server); err != nil {
+				t.Error(err)
+				return
+			}
+			// The echo socket drops bursts, retry until a reply.
+			for j := 0; j < 100 && atomic.LoadInt64(&c.replies) == 0; j++ {
+				if err := h.ReceiveTo(c, []byte("ping"), server); err != nil {
+					t.Error(err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}(conns[i])
+	}
+	wg.Wait()
+	if n := h.conns.Len(); n != flows {
+		t.Fatalf("sessions %d", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		got := 0
+		for _, c := range conns {
+			if atomic.LoadInt64(&c.replies) > 0 {
+				got++
+			}
+		}
+		if got == flows {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	missing := 0
+	for _, c := range conns {
+		if atomic.LoadInt64(&c.replies) == 0 {
+			missing++
+		}
+	}
+	if missing > 0 {
+		t.Fatalf("%d flows got no reply", missing)
+	}
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *tableConn) {
+			defer wg.Done()
+			h.Close(c)
+		}(c)
+	}
+	wg.Wait()
+	if n := h.conns.Len(); n != 0 {
+		t.Fatalf("sessions left %d", n)
+	}
+}
+
+// Direct sessions to fake IPs send to the real addresses, and replies come
+// back from the fake ones. Fake IPs other than the target are resolved by
+// the writer of the session.
+func TestUDPFakeIPs(t *testing.T) {
+	first, second := echoServer(t, true), echoServer(t, true)
+	fakeFirst := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 1), Port: first.Port}
+	fakeSecond := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 2), Port: second.Port}
+	h := NewUDPHandler(nil, &Config{
+		Exceptions:  NewExceptions(Route{Action: ActionDirect}),
+		UDPTimeouts: &conntrack.UDPTimeouts{Default: time.Minute},
+		FakeDNS:     fakeDomains{"198.18.0.1": "localhost", "198.18.0.2": "localhost"},
+	}).(*udpHandler)
+
+	c := newTableConn(1)
+	c.sources = make(chan string, 2)
+	if err := h.Connect(c, fakeFirst); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close(c)
+	for _, addr := range []*net.UDPAddr{fakeFirst, fakeSecond} {
+		if err := h.ReceiveTo(c, []byte("ping"), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case source := <-c.sources:
+			got[source] = true
+		case <-time.After(3 * time.Second):
+			t.Fatalf("replies from %v", got)
+		}
+	}
+	if !got[fakeFirst.String()] || !got[fakeSecond.String()] {
+		t.Fatalf("replies from %v", got)
+	}
+}
+
+// BenchmarkUDPReceiveTo4096Flows sends packets of 4096 direct sessions in
+// parallel, as the lwIP thread hands them to ReceiveTo.
+func BenchmarkUDPReceiveTo4096Flows(b *testing.B) {
+	server := echoServer(b, false)
+	h := NewUDPHandler(nil, &Config{
+		Exceptions:  NewExceptions(Route{Action: ActionDirect}),
+		UDPTimeouts: &conntrack.UDPTimeouts{Default: time.Minute},
+	}).(*udpHandler)
+	const flows = 4096
+	conns := make([]*tableConn, flows)
+	for i := range conns {
+		conns[i] = newTableConn(i)
+		if err := h.Connect(conns[i], server); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, c := range conns {
+			h.Close(c)
+		}
+	}()
+	data := make([]byte, 64)
+	var next int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := atomic.AddInt64(&next, 1)
+		for pb.Next() {
+			i += 7
+			if err := h.ReceiveTo(conns[i%flows], data, server); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+	"github.com/zinoulink/tun2ray/d"
+
+	voutbound "github.com/v2fly/v2ray-core/v4/features/outbound"
+	vstats "github.com/v2fly/v2ray-core/v4/features/stats"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// Status is a summary of a running engine.
+type Status struct {
+	Started  time.Time `json:"started"`
+	Uptime   string    `json:"uptime"`
+	LogLevel string    `json:"logLevel"`
+	TCPConns int       `json:"tcpConns"`
+	UDPConns int       `json:"udpConns"`
+	Options  *Options  `json:"options"`
+}
+
+func (e *Engine) Status() *Status {
+	s := &Status{
+		Started:  e.started,
+		Uptime:   time.Since(e.started).Round(time.Second).String(),
+		LogLevel: e.LogLevel(),
+		Options:  e.Options,
+	}
+	for _, c := range e.Connections() {
+		if c.Network == "tcp" {
+			s.TCPConns++
+		} else {
+			s.UDPConns++
+		}
+	}
+	return s
+}
+
+// Connections returns the active connections.
+func (e *Engine) Connections() []conntrack.Conn {
+	return conntrack.Snapshot(e.Tracker.Active())
+}
+
+// KillConnections closes the active connections matching filter, both the
+// local side and the V2Ray or direct one, and returns their IDs.
+func (e *Engine) KillConnections(filter conntrack.Filter) []uint64 {
+	ids := e.Tracker.KillMatching(filter)
+	if len(ids) > 0 {
+		log.Infof("killed %d connections", len(ids))
+	}
+	return ids
+}
+
+// ClosedConnections returns the connections closed within the history
+// window, the most recently closed last.
+func (e *Engine) ClosedConnections() []conntrack.Conn {
+	return conntrack.Snapshot(e.Tracker.Closed())
+}
+
+// Stats returns the V2Ray stats counters, it fails if stats are not enabled
+// in V2Ray config.
+func (e *Engine) Stats() (map[string]int64, error) {
+	sm, ok := e.Instance.GetFeature(vstats.ManagerType()).(interface {
+		VisitCounters(func(string, vstats.Counter) bool)
+	})
+	if !ok {
+		return nil, errors.New("stats are not enabled in V2Ray config")
+	}
+	counters := make(map[string]int64)
+	sm.VisitCounters(func(name string, c vstats.Counter) bool {
+		counters[name] = c.Value()
+		return true
+	})
+	return counters, nil
+}
+
+func (e *Engine) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+			counters, err := e.Stats()
+			if err != nil {
+				log.Warnf("%v", err)
+				return
+			}
+			for _, name := range sortedKeys(counters) {
+				log.Infof("stats: %s = %d", name, counters[name])
+			}
+		}
+	}
+}
+
+// SetLogLevel sets the level of tun2ray logs, one of "debug", "info",
+// "warning", "error" and "none".
+func (e *Engine) SetLogLevel(level string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	log.SetLevel(l)
+	e.logLevel = strings.ToLower(level)
+	return nil
+}
+
+func (e *Engine) LogLevel() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.logLevel
+}
+
+func parseLogLevel(level string) (log.LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return log.DEBUG, nil
+	case "", "info":
+		return log.INFO, nil
+	case "warning", "warn":
+		return log.WARN, nil
+	case "error":
+		return log.ERROR, nil
+	case "none":
+		return log.NONE, nil
+	default:
+		return log.INFO, errors.New("invalid log level: " + level)
+	}
+}
+
+// ExceptionOptions returns the current exceptions.
+func (e *Engine) ExceptionOptions() ExceptionOptions {
+	return ExceptionOptions{
+		Default:     e.Exceptions.Default().String(),
+		Direct:      e.Exceptions.Direct(),
+		Proxy:       e.Exceptions.Proxy(),
+		Outbounds:   e.Exceptions.Outbounds(),
+		SendThrough: e.Options.Exceptions.SendThrough,
+	}
+}
+
+// SetExceptionOptions replaces the exceptions, they apply to new connections.
+// The send through address can not be changed while running. It fails if an
+// outbound tag is not in V2Ray config.
+func (e *Engine) SetExceptionOptions(opts ExceptionOptions) error {
+	if err := e.checkOutbounds(opts); err != nil {
+		return err
+	}
+	e.Exceptions.SetDefault(d.ParseRoute(opts.Default))
+	e.Exceptions.SetDirect(opts.Direct)
+	e.Exceptions.SetProxy(opts.Proxy)
+	e.Exceptions.SetOutbounds(opts.Outbounds)
+	return nil
+}
+
+// checkOutbounds makes sure the outbound tags of opts are in V2Ray config,
+// as V2Ray drops connections sent to a missing outbound.
+func (e *Engine) checkOutbounds(opts ExceptionOptions) error {
+	if route := d.ParseRoute(opts.Default); route.Action == d.ActionOutbound && !e.hasOutbound(route.Tag) {
+		return fmt.Errorf("default outbound %s is not in V2Ray config", route.Tag)
+	}
+	apps := make([]string, 0, len(opts.Outbounds))
+	for app := range opts.Outbounds {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	for _, app := range apps {
+		if route := d.ParseRoute(opts.Outbounds[app]); route.Action == d.ActionOutbound && !e.hasOutbound(route.Tag) {
+			return fmt.Errorf("outbound %s of %s is not in V2Ray config", route.Tag, app)
+		}
+	}
+	return nil
+}
+
+// hasOutbound reports whether tag is an outbound of V2Ray config.
+func (e *Engine) hasOutbound(tag string) bool {
+	om, ok := e.Instance.GetFeature(voutbound.ManagerType()).(voutbound.Manager)
+	if !ok {
+		return true
+	}
+	return om.GetHandler(tag) != nil
+}
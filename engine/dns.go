@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"errors"
+	"net"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// dnsHandler sends sessions to DNS servers to one handler and everything
+// else to another. The decision is made once per session in Connect, so
+// that all the packets of a session go to the same handler.
+type dnsHandler struct {
+	dnsHandler core.UDPConnHandler
+	udpHandler core.UDPConnHandler
+	// sessions maps the conns from the core to their dnsConn.
+	sessions *conntrack.UDPTable
+}
+
+// dnsConn is given to the handler chosen for the session in place of the
+// conn from the core, so that the session is forgotten when it closes.
+type dnsConn struct {
+	core.UDPConn
+
+	handler *dnsHandler
+	next    core.UDPConnHandler
+}
+
+func (c *dnsConn) Flow() *conntrack.Flow {
+	return conntrack.FlowOf(c.UDPConn)
+}
+
+func (c *dnsConn) Close() error {
+	c.handler.sessions.LoadAndDelete(c.UDPConn)
+	return c.UDPConn.Close()
+}
+
+func newDNSHandler(queries, others core.UDPConnHandler) core.UDPConnHandler {
+	return &dnsHandler{
+		dnsHandler: queries,
+		udpHandler: others,
+		sessions:   conntrack.NewUDPTable(),
+	}
+}
+
+func isDNS(addr *net.UDPAddr) bool {
+	return addr != nil && addr.Port == dns.COMMON_DNS_PORT
+}
+
+func (h *dnsHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	c := &dnsConn{UDPConn: conn, handler: h, next: h.udpHandler}
+	if isDNS(target) {
+		c.next = h.dnsHandler
+	}
+	h.sessions.Store(conn, c)
+	if err := c.next.Connect(c, target); err != nil {
+		h.sessions.LoadAndDelete(conn)
+		return err
+	}
+	return nil
+}
+
+func (h *dnsHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	c, ok := h.sessions.Load(conn)
+	if !ok {
+		return errors.New("session of " + conn.LocalAddr().String() + " does not exist")
+	}
+	return c.(*dnsConn).next.ReceiveTo(c.(*dnsConn), data, addr)
+}
+
+// Close releases the session of conn in the handler it was sent to.
+func (h *dnsHandler) Close(conn core.UDPConn) {
+	c, ok := h.sessions.LoadAndDelete(conn)
+	if !ok {
+		return
+	}
+	if closer, ok := c.(*dnsConn).next.(conntrack.UDPCloser); ok {
+		closer.Close(c.(*dnsConn))
+	}
+}
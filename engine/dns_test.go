@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"net"
+	"testing"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// sessionConn is a UDP session from the core.
+type sessionConn struct {
+	addr   *net.UDPAddr
+	closed bool
+}
+
+func (c *sessionConn) LocalAddr() *net.UDPAddr                        { return c.addr }
+func (c *sessionConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+func (c *sessionConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	return len(data), nil
+}
+func (c *sessionConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// countingHandler counts the packets it is given.
+type countingHandler struct {
+	connects int
+	packets  int
+	last     core.UDPConn
+}
+
+func (h *countingHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	h.connects++
+	h.last = conn
+	return nil
+}
+
+func (h *countingHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	h.packets++
+	return nil
+}
+
+// All the packets of a session go to the handler chosen by Connect, whatever
+// their destination port.
+func TestDNSHandlerRoutesSessions(t *testing.T) {
+	queries, others := &countingHandler{}, &countingHandler{}
+	h := newDNSHandler(queries, others)
+	dnsServer := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53}
+	server := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443}
+
+	dnsConn := &sessionConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}}
+	otherConn := &sessionConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1001}}
+	if err := h.Connect(dnsConn, dnsServer); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Connect(otherConn, server); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []*net.UDPAddr{dnsServer, server} {
+		h.ReceiveTo(dnsConn, nil, addr)
+		h.ReceiveTo(otherConn, nil, addr)
+	}
+	if queries.connects != 1 || queries.packets != 2 || others.connects != 1 || others.packets != 2 {
+		t.Fatalf("DNS handler got %d sessions and %d packets, other one %d and %d",
+			queries.connects, queries.packets, others.connects, others.packets)
+	}
+
+	// The session is forgotten once the handler closes it.
+	queries.last.Close()
+	if !dnsConn.closed {
+		t.Fatal("session from the core not closed")
+	}
+	if err := h.ReceiveTo(dnsConn, nil, dnsServer); err == nil {
+		t.Fatal("closed session still routed")
+	}
+}
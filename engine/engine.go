@@ -0,0 +1,250 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zinoulink/tun2ray/accounting"
+	"github.com/zinoulink/tun2ray/blocklist"
+	"github.com/zinoulink/tun2ray/conntrack"
+	"github.com/zinoulink/tun2ray/d"
+	"github.com/zinoulink/tun2ray/dnsfallback"
+	"github.com/zinoulink/tun2ray/fakedns"
+	"github.com/zinoulink/tun2ray/v2ray"
+
+	vcore "github.com/v2fly/v2ray-core/v4"
+	vbytespool "github.com/v2fly/v2ray-core/v4/common/bytespool"
+	vsession "github.com/v2fly/v2ray-core/v4/common/session"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/common/log/simple"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// Engine is a running V2Ray instance with the tun2socks connection handlers
+// built on top of it.
+type Engine struct {
+	Options    *Options
+	Instance   *vcore.Instance
+	Exceptions *d.Exceptions
+	Rules      *d.Rules
+	FakeDNS    *fakedns.Pool   // nil unless DNSMode is "fake"
+	Blocklist  *blocklist.List // nil without blocklist files
+	TCPHandler core.TCPConnHandler
+	UDPHandler core.UDPConnHandler
+	Tracker    *conntrack.Tracker
+	Accountant *accounting.Accountant
+
+	mu       sync.Mutex // guards logLevel
+	logLevel string
+	started  time.Time
+	done     chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var registerLogger sync.Once
+
+// New starts a V2Ray instance from the JSON config and builds the connection
+// handlers. Connections are routed per app with the exceptions of opts if
+// lookup is not nil.
+func New(config []byte, opts *Options, lookup d.ProcessLookup) (*Engine, error) {
+	registerLogger.Do(func() {
+		log.RegisterLogger(simple.NewSimpleLogger())
+	})
+
+	if opts.AssetDir != "" {
+		v2ray.SetAssetDir(opts.AssetDir)
+	}
+
+	// Share the buffer pool.
+	core.SetBufferPool(vbytespool.GetPool(core.BufSize))
+
+	portTimeouts := make(map[string]time.Duration, len(opts.UDPPortTimeouts))
+	for port, timeout := range opts.UDPPortTimeouts {
+		portTimeouts[port] = time.Duration(timeout)
+	}
+	udpTimeouts, err := conntrack.NewUDPTimeouts(time.Duration(opts.UDPTimeout), portTimeouts)
+	if err != nil {
+		return nil, errors.New("invalid UDP timeouts: " + err.Error())
+	}
+
+	e := &Engine{
+		Options: opts,
+		started: time.Now(),
+		Tracker: conntrack.NewTracker(time.Duration(opts.ConnHistory), udpTimeouts),
+		done:    make(chan struct{}),
+	}
+	if err := e.SetLogLevel(opts.LogLevel); err != nil {
+		return nil, err
+	}
+
+	accountant, err := accounting.New(opts.Accounting.File)
+	if err != nil {
+		return nil, errors.New("load usage failed: " + err.Error())
+	}
+	e.Accountant = accountant
+
+	if opts.DNSMode == DNSModeFake {
+		pool, err := fakedns.NewPool(opts.FakeDNS.IPPool, opts.FakeDNS.PoolSize)
+		if err != nil {
+			return nil, err
+		}
+		e.FakeDNS = pool
+	}
+
+	var sendThrough net.Addr
+	if opts.Exceptions.SendThrough != "" {
+		addr, err := net.ResolveTCPAddr("tcp", opts.Exceptions.SendThrough)
+		if err != nil {
+			return nil, errors.New("invalid exception send through address: " + err.Error())
+		}
+		sendThrough = addr
+	}
+
+	var cidrs []string
+	if opts.Bypass.Private {
+		cidrs = append(cidrs, d.PrivateNetworks...)
+	}
+	bypass, err := d.NewBypass(append(cidrs, opts.Bypass.CIDRs...), opts.Bypass.Ports, opts.Bypass.Domains)
+	if err != nil {
+		return nil, errors.New("invalid bypass: " + err.Error())
+	}
+
+	if len(opts.Blocklist.Files) > 0 {
+		list, err := blocklist.Load(opts.Blocklist.Files, opts.Blocklist.AllowFiles, opts.Blocklist.Allow)
+		if err != nil {
+			return nil, errors.New("load blocklist failed: " + err.Error())
+		}
+		e.Blocklist = list
+		log.Infof("blocklist: %d domains", list.Len())
+	}
+
+	// Start the V2Ray instance.
+	v, err := vcore.StartInstance("json", config)
+	if err != nil {
+		return nil, errors.New("start V instance failed: " + err.Error())
+	}
+	e.Instance = v
+
+	ctx := contextWithSniffing(context.Background(), opts.Sniffing)
+	ctx = vsession.ContextWithInbound(ctx, &vsession.Inbound{Tag: opts.InboundTag})
+
+	// Avoid a typed nil interface in the handlers.
+	var fakeDNS v2ray.FakeDNS
+	if e.FakeDNS != nil {
+		fakeDNS = e.FakeDNS
+	}
+	tcpHalfOpenTimeout := time.Duration(opts.TCPHalfOpenTimeout)
+
+	// Create v2ray handlers.
+	e.TCPHandler = v2ray.NewTCPHandler(ctx, v, fakeDNS, tcpHalfOpenTimeout)
+	if opts.UDPEnabled {
+		e.UDPHandler = v2ray.NewUDPHandler(ctx, v, fakeDNS, udpTimeouts, opts.UDPPolicyLevel)
+	} else {
+		e.UDPHandler = dnsfallback.NewUDPHandler()
+	}
+	switch opts.DNSMode {
+	case DNSModeTCP:
+		e.UDPHandler = newDNSHandler(dnsfallback.NewUDPHandler(), e.UDPHandler)
+	case DNSModeFake:
+		e.UDPHandler = newDNSHandler(fakedns.NewUDPHandler(e.FakeDNS), e.UDPHandler)
+	}
+	if e.Blocklist != nil {
+		e.UDPHandler = newDNSHandler(blocklist.NewUDPHandler(e.Blocklist, e.UDPHandler), e.UDPHandler)
+	}
+
+	// Create d handlers.
+	e.Exceptions = d.NewExceptions(d.ParseRoute(opts.Exceptions.Default))
+	if err := e.SetExceptionOptions(opts.Exceptions); err != nil {
+		v.Close()
+		return nil, err
+	}
+	e.Rules = new(d.Rules)
+	rules, err := e.loadRules()
+	if err == nil {
+		err = e.SetRules(rules)
+	}
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+	// Always routed, as rules and exceptions can be set once started.
+	dConfig := &d.Config{
+		Bypass:             bypass,
+		Blocklist:          e.Blocklist,
+		Rules:              e.Rules,
+		Exceptions:         e.Exceptions,
+		Lookup:             lookup,
+		SendThrough:        sendThrough,
+		UDPTimeouts:        udpTimeouts,
+		TCPHalfOpenTimeout: tcpHalfOpenTimeout,
+		Sniffing:           opts.Sniffing,
+		SniffTimeout:       time.Duration(opts.SniffTimeout),
+	}
+	if e.FakeDNS != nil {
+		dConfig.FakeDNS = e.FakeDNS
+	}
+	e.TCPHandler = d.NewTCPHandler(e.TCPHandler, dConfig)
+	e.UDPHandler = d.NewUDPHandler(e.UDPHandler, dConfig)
+
+	// Keep track of connections.
+	e.TCPHandler = conntrack.NewTCPHandler(e.TCPHandler, e.Tracker)
+	e.UDPHandler = conntrack.NewUDPHandler(e.UDPHandler, e.Tracker, opts.MaxUDPSessions)
+
+	if opts.Accounting.Interval > 0 {
+		// The tracker keeps closed flows for accounting from the first
+		// update on, update once now so that those closed before the
+		// first interval are counted.
+		e.updateUsage()
+		go e.account(time.Duration(opts.Accounting.Interval))
+	}
+	if opts.StatsInterval > 0 {
+		go e.logStats(time.Duration(opts.StatsInterval))
+	}
+
+	return e, nil
+}
+
+// Register registers the engine handlers as tun2socks connection handlers.
+func (e *Engine) Register() {
+	core.RegisterTCPConnHandler(e.TCPHandler)
+	core.RegisterUDPConnHandler(e.UDPHandler)
+}
+
+// Close stops the V2Ray instance, after saving usage. Closing it again does
+// nothing and returns the error of the first call.
+func (e *Engine) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		e.updateUsage()
+		if err := e.Accountant.Save(); err != nil {
+			log.Warnf("save usage failed: %v", err)
+		}
+		e.closeErr = e.Instance.Close()
+	})
+	return e.closeErr
+}
+
+// contextWithSniffing configures sniffing for traffic coming from tun2socks.
+func contextWithSniffing(ctx context.Context, sniffing []string) context.Context {
+	var validSniffings []string
+	for _, s := range sniffing {
+		if s == "http" || s == "tls" {
+			validSniffings = append(validSniffings, s)
+		}
+	}
+
+	content := vsession.ContentFromContext(ctx)
+	if content == nil {
+		content = new(vsession.Content)
+		ctx = vsession.ContextWithContent(ctx, content)
+	}
+	content.SniffingRequest.Enabled = len(validSniffings) != 0
+	content.SniffingRequest.OverrideDestinationForProtocol = validSniffings
+	return ctx
+}
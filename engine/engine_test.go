@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zinoulink/tun2ray/accounting"
+)
+
+func TestCloseTwice(t *testing.T) {
+	opts := DefaultOptions()
+	opts.LogLevel = "none"
+	e, err := New([]byte(`{"outbounds":[{"protocol":"freedom"}]}`), opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Flows closed before the first accounting interval are counted.
+func TestUsageBeforeFirstInterval(t *testing.T) {
+	opts := DefaultOptions()
+	opts.LogLevel = "none"
+	opts.Accounting.Interval = Duration(time.Hour)
+	e, err := New([]byte(`{"outbounds":[{"protocol":"freedom"}]}`), opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	f := e.Tracker.Add("tcp", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}, &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 443})
+	f.SetProcess("firefox")
+	f.AddUpload(100)
+	f.AddDownload(1000)
+	f.Close("closed")
+
+	u := e.Usage().Days[time.Now().Format("2006-01-02")]["firefox"]
+	if u == nil || u.Total() != (accounting.Counters{Upload: 100, Download: 1000, Flows: 1}) {
+		t.Fatalf("usage %+v", u)
+	}
+}
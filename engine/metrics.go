@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"io"
+	"sort"
+	"sync/atomic"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+	"github.com/zinoulink/tun2ray/d"
+	"github.com/zinoulink/tun2ray/metrics"
+)
+
+// WriteMetrics writes the engine metrics in the Prometheus text format.
+func (e *Engine) WriteMetrics(w io.Writer) error {
+	mw := metrics.NewWriter(w)
+
+	active := map[string]int{"tcp": 0, "udp": 0}
+	for _, c := range e.Connections() {
+		active[c.Network]++
+	}
+	mw.Header("tun2ray_active_flows", "gauge", "Active flows.")
+	for _, network := range []string{"tcp", "udp"} {
+		mw.Sample("tun2ray_active_flows", float64(active[network]), "network", network)
+	}
+
+	totals := e.Tracker.Totals()
+	opened := make([]conntrack.RouteKey, 0, len(totals.Opened))
+	for k := range totals.Opened {
+		opened = append(opened, k)
+	}
+	sort.Slice(opened, func(i, j int) bool {
+		if opened[i].Network != opened[j].Network {
+			return opened[i].Network < opened[j].Network
+		}
+		return opened[i].Route < opened[j].Route
+	})
+	mw.Header("tun2ray_flows_opened_total", "counter", "Flows opened by route.")
+	for _, k := range opened {
+		mw.Sample("tun2ray_flows_opened_total", float64(totals.Opened[k]), "network", k.Network, "route", k.Route)
+	}
+
+	mw.Header("tun2ray_blocked_flows_total", "counter", "Flows blocked by rules or exceptions.")
+	for _, network := range []string{"tcp", "udp"} {
+		blocked := totals.Opened[conntrack.RouteKey{Network: network, Route: d.ActionBlock.String()}]
+		mw.Sample("tun2ray_blocked_flows_total", float64(blocked), "network", network)
+	}
+
+	mw.Header("tun2ray_dial_errors_total", "counter", "Flows that failed to open by reason.")
+	for _, reason := range sortedKeys(totals.Errors) {
+		mw.Sample("tun2ray_dial_errors_total", float64(totals.Errors[reason]), "reason", reason)
+	}
+
+	mw.Header("tun2ray_relayed_bytes_total", "counter", "Bytes relayed, sent by local apps (up) or received by them (down).")
+	mw.Sample("tun2ray_relayed_bytes_total", float64(totals.Upload), "direction", "up")
+	mw.Sample("tun2ray_relayed_bytes_total", float64(totals.Download), "direction", "down")
+
+	mw.Header("tun2ray_tun_packets_total", "counter", "Packets read from or written to the TUN device.")
+	mw.Sample("tun2ray_tun_packets_total", float64(atomic.LoadUint64(&Tun.packetsRead)), "direction", "read")
+	mw.Sample("tun2ray_tun_packets_total", float64(atomic.LoadUint64(&Tun.packetsWritten)), "direction", "write")
+	mw.Header("tun2ray_tun_bytes_total", "counter", "Bytes read from or written to the TUN device.")
+	mw.Sample("tun2ray_tun_bytes_total", float64(atomic.LoadUint64(&Tun.bytesRead)), "direction", "read")
+	mw.Sample("tun2ray_tun_bytes_total", float64(atomic.LoadUint64(&Tun.bytesWritten)), "direction", "write")
+
+	mw.Histogram("tun2ray_process_lookup_seconds", "Time spent finding the app owning a connection.", d.LookupLatency)
+
+	if e.FakeDNS != nil {
+		stats := e.FakeDNS.Stats()
+		mw.Header("tun2ray_fakedns_entries", "gauge", "Fake DNS addresses in use.")
+		mw.Sample("tun2ray_fakedns_entries", float64(stats.Size))
+		mw.Header("tun2ray_fakedns_capacity", "gauge", "Maximum fake DNS addresses in use.")
+		mw.Sample("tun2ray_fakedns_capacity", float64(stats.Capacity))
+		mw.Header("tun2ray_fakedns_queries_total", "counter", "Fake DNS queries by result.")
+		mw.Sample("tun2ray_fakedns_queries_total", float64(stats.Hits), "result", "hit")
+		mw.Sample("tun2ray_fakedns_queries_total", float64(stats.Misses), "result", "miss")
+		mw.Header("tun2ray_fakedns_evictions_total", "counter", "Fake DNS addresses recycled.")
+		mw.Sample("tun2ray_fakedns_evictions_total", float64(stats.Evictions))
+		mw.Header("tun2ray_fakedns_lookups_total", "counter", "Fake addresses translated back to domains by result.")
+		mw.Sample("tun2ray_fakedns_lookups_total", float64(stats.Lookups-stats.Unknown), "result", "found")
+		mw.Sample("tun2ray_fakedns_lookups_total", float64(stats.Unknown), "result", "unknown")
+	}
+
+	if e.Blocklist != nil {
+		mw.Header("tun2ray_blocklist_domains", "gauge", "Domains of the blocklist.")
+		mw.Sample("tun2ray_blocklist_domains", float64(e.Blocklist.Len()))
+		mw.Header("tun2ray_blocklist_hits_total", "counter", "DNS queries and connections for blocked domains.")
+		mw.Sample("tun2ray_blocklist_hits_total", float64(e.Blocklist.Hits()))
+	}
+
+	// V2Ray counters are only there if stats are enabled in V2Ray config.
+	if counters, err := e.Stats(); err == nil {
+		mw.Header("tun2ray_v2ray_counter", "counter", "V2Ray stats counters.")
+		for _, name := range sortedKeys(counters) {
+			mw.Sample("tun2ray_v2ray_counter", float64(counters[name]), "name", name)
+		}
+	}
+
+	return mw.Flush()
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,237 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/zinoulink/tun2ray/d"
+)
+
+// DNS modes, see Options.DNSMode.
+const (
+	DNSModeUDP  = "udp"
+	DNSModeTCP  = "tcp"
+	DNSModeFake = "fake"
+)
+
+// Options are the settings of an engine. They are usually decoded from
+// JSON, unknown fields are ignored and missing ones keep their defaults, so
+// that hosts built against older versions keep working.
+type Options struct {
+	// MTU of the TUN device.
+	MTU int `json:"mtu"`
+
+	// AssetDir is where V2Ray loads geoip.dat and geosite.dat from.
+	AssetDir string `json:"assetDir"`
+
+	// Sniffing lists the protocols V2Ray sniffs to override the
+	// destination with a domain, among "http" and "tls".
+	Sniffing []string `json:"sniffing"`
+
+	// SniffTimeout is how long the first bytes of TCP connections are
+	// waited for, to sniff their domain for bypass domains and rules.
+	SniffTimeout Duration `json:"sniffTimeout"`
+
+	// InboundTag is the tag V2Ray routing rules see for traffic coming
+	// from the TUN device.
+	InboundTag string `json:"inboundTag"`
+
+	// UDPEnabled sends UDP traffic to V2Ray, otherwise only DNS queries
+	// are handled, and answered with truncated responses.
+	UDPEnabled bool `json:"udpEnabled"`
+
+	// UDPTimeout is the idle timeout of UDP sessions.
+	UDPTimeout Duration `json:"udpTimeout"`
+
+	// UDPPortTimeouts override UDPTimeout by destination port or port
+	// range, e.g. {"53": "10s", "27015-27030": "10m"}. They replace the
+	// default {"53": "10s"}, {} keeps UDPTimeout for every port.
+	UDPPortTimeouts map[string]Duration `json:"udpPortTimeouts"`
+
+	// UDPPolicyLevel is the V2Ray policy level whose connIdle timeout
+	// overrides the timeouts of UDP sessions sent to V2Ray, negative
+	// ignores V2Ray policies.
+	UDPPolicyLevel int `json:"udpPolicyLevel"`
+
+	// MaxUDPSessions caps the number of UDP sessions, the least recently
+	// active ones are closed past it. Zero is unlimited.
+	MaxUDPSessions int `json:"maxUdpSessions"`
+
+	// TCPHalfOpenTimeout is how long TCP connections closed by one side
+	// are kept open without data, zero waits forever.
+	TCPHalfOpenTimeout Duration `json:"tcpHalfOpenTimeout"`
+
+	// DNSMode tells how DNS queries over UDP are handled: "udp" sends them
+	// like any other UDP traffic, "tcp" makes clients retry over TCP and
+	// "fake" answers them locally with fake IPs.
+	DNSMode string `json:"dnsMode"`
+
+	FakeDNS FakeDNSOptions `json:"fakeDns"`
+
+	Exceptions ExceptionOptions `json:"exceptions"`
+
+	Bypass BypassOptions `json:"bypass"`
+
+	Blocklist BlocklistOptions `json:"blocklist"`
+
+	// Rules route connections before the exceptions, the first matching
+	// rule wins. They are read from RulesFile if set, a YAML file or a
+	// JSON one if its name ends with .json.
+	Rules     []d.RuleConfig `json:"rules"`
+	RulesFile string         `json:"rulesFile"`
+
+	// LogLevel is one of "debug", "info", "warning", "error" and "none".
+	LogLevel string `json:"logLevel"`
+
+	// ConnHistory is how long closed connections are kept in the
+	// connection tracker.
+	ConnHistory Duration `json:"connHistory"`
+
+	Accounting AccountingOptions `json:"accounting"`
+
+	// StatsInterval is how often V2Ray stats counters are logged, zero
+	// disables it.
+	StatsInterval Duration `json:"statsInterval"`
+}
+
+// FakeDNSOptions are the settings of the "fake" DNS mode.
+type FakeDNSOptions struct {
+	// IPPool is the IPv4 range fake IPs are taken from.
+	IPPool string `json:"ipPool"`
+	// PoolSize is the maximum number of fake IPs in use, the least
+	// recently used one is recycled past it.
+	PoolSize int `json:"poolSize"`
+}
+
+// AccountingOptions are the settings of per-app traffic accounting.
+type AccountingOptions struct {
+	// File is where daily and monthly usage is saved as JSON and loaded
+	// from on start, usage is kept in memory only if empty.
+	File string `json:"file"`
+	// Interval is how often usage is updated from the connections and
+	// saved.
+	Interval Duration `json:"interval"`
+}
+
+// BypassOptions send connections direct by destination, before the rules
+// and without looking up the owning app.
+type BypassOptions struct {
+	// Private bypasses the loopback, private, link-local and multicast
+	// ranges.
+	Private bool `json:"private"`
+	// CIDRs lists destination ranges or addresses.
+	CIDRs []string `json:"cidrs"`
+	// Ports lists destination ports or ranges, e.g. "8000-9000".
+	Ports []string `json:"ports"`
+	// Domains lists destination domains, matching their subdomains too.
+	// The domain of a connection is known from fake DNS or sniffing.
+	Domains []string `json:"domains"`
+}
+
+// BlocklistOptions block domains, DNS queries for them are answered with
+// NXDOMAIN and connections to them are blocked when their domain is known.
+type BlocklistOptions struct {
+	// Files are lists in the hosts, AdBlock or one domain per line format.
+	Files []string `json:"files"`
+	// AllowFiles are lists of domains never blocked, in the same formats.
+	AllowFiles []string `json:"allowFiles"`
+	// Allow lists domains never blocked.
+	Allow []string `json:"allow"`
+}
+
+// ExceptionOptions route connections by the application owning them.
+type ExceptionOptions struct {
+	// Default is the route of apps matching none of the lists, "proxy",
+	// "direct" or an outbound tag.
+	Default string `json:"default"`
+	// Direct lists the apps going direct.
+	Direct []string `json:"direct"`
+	// Proxy lists the apps going to the proxy.
+	Proxy []string `json:"proxy"`
+	// Outbounds maps apps to the tag of the V2Ray outbound they use, or
+	// to "block" or "drop".
+	Outbounds map[string]string `json:"outbounds"`
+	// SendThrough is the local address direct connections are sent
+	// through, e.g. "192.168.1.3:0".
+	SendThrough string `json:"sendThrough"`
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		MTU:          1500,
+		Sniffing:     []string{"http", "tls"},
+		SniffTimeout: Duration(200 * time.Millisecond),
+		InboundTag:   "tun",
+		UDPEnabled:   true,
+		UDPTimeout:   Duration(1 * time.Minute),
+		UDPPortTimeouts: map[string]Duration{
+			"53": Duration(10 * time.Second),
+		},
+		UDPPolicyLevel:     -1,
+		MaxUDPSessions:     4096,
+		TCPHalfOpenTimeout: Duration(1 * time.Minute),
+		DNSMode:            DNSModeUDP,
+		FakeDNS: FakeDNSOptions{
+			IPPool:   "198.18.0.0/15",
+			PoolSize: 65535,
+		},
+		Exceptions: ExceptionOptions{
+			Default: "proxy",
+		},
+		LogLevel:    "info",
+		ConnHistory: Duration(5 * time.Minute),
+		Accounting: AccountingOptions{
+			Interval: Duration(1 * time.Minute),
+		},
+	}
+}
+
+// ParseOptions decodes JSON options on top of the defaults. An empty string
+// gives the defaults.
+func ParseOptions(s string) (*Options, error) {
+	opts := DefaultOptions()
+	if strings.TrimSpace(s) == "" {
+		return opts, nil
+	}
+	// Maps are merged into by json, the default port timeouts only apply
+	// if the options have none.
+	defaultPortTimeouts := opts.UDPPortTimeouts
+	opts.UDPPortTimeouts = nil
+	if err := json.Unmarshal([]byte(s), opts); err != nil {
+		return nil, err
+	}
+	if opts.UDPPortTimeouts == nil {
+		opts.UDPPortTimeouts = defaultPortTimeouts
+	}
+	return opts, nil
+}
+
+// Duration is a time.Duration encoded in JSON as a string such as "1m30s",
+// or as a number of seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return errors.New("invalid duration: " + string(b))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zinoulink/tun2ray/d"
+)
+
+// RuleConfigs returns the routing rules.
+func (e *Engine) RuleConfigs() []d.RuleConfig {
+	return e.Rules.Configs()
+}
+
+// SetRules replaces the routing rules, they apply to new connections. It
+// fails if a rule is invalid or sends to an outbound missing from V2Ray
+// config.
+func (e *Engine) SetRules(configs []d.RuleConfig) error {
+	for i, c := range configs {
+		if route := d.ParseRoute(c.Action); route.Action == d.ActionOutbound && !e.hasOutbound(route.Tag) {
+			return fmt.Errorf("rule %d: outbound %s is not in V2Ray config", i+1, route.Tag)
+		}
+	}
+	return e.Rules.Set(configs)
+}
+
+// ReloadRules reads the rules file again.
+func (e *Engine) ReloadRules() error {
+	if e.Options.RulesFile == "" {
+		return errors.New("no rules file")
+	}
+	configs, err := e.loadRules()
+	if err != nil {
+		return err
+	}
+	return e.SetRules(configs)
+}
+
+// loadRules returns the rules of the options, read from the rules file if
+// there is one.
+func (e *Engine) loadRules() ([]d.RuleConfig, error) {
+	if e.Options.RulesFile == "" {
+		return e.Options.Rules, nil
+	}
+	return d.LoadRulesFile(e.Options.RulesFile)
+}
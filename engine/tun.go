@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// TunCounters count packets between the TUN device and the stack.
+type TunCounters struct {
+	packetsRead    uint64
+	bytesRead      uint64
+	packetsWritten uint64
+	bytesWritten   uint64
+}
+
+// Tun is updated by the packet loops of the front ends, which outlive
+// engines.
+var Tun TunCounters
+
+// Read counts a packet of n bytes read from the TUN device.
+func (c *TunCounters) Read(n int) {
+	atomic.AddUint64(&c.packetsRead, 1)
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+}
+
+// Written counts a packet of n bytes written to the TUN device, failed
+// writes are not counted.
+func (c *TunCounters) Written(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(&c.packetsWritten, 1)
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+}
+
+// Reader counts reads from r, each read from a TUN device being a packet.
+func (c *TunCounters) Reader(r io.Reader) io.Reader {
+	return &tunReader{r, c}
+}
+
+type tunReader struct {
+	io.Reader
+	counters *TunCounters
+}
+
+func (r *tunReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.counters.Read(n)
+	}
+	return n, err
+}
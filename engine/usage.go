@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/zinoulink/tun2ray/accounting"
+	"github.com/zinoulink/tun2ray/conntrack"
+
+	"github.com/eycorsican/go-tun2socks/common/log"
+)
+
+// Usage returns the traffic of each app by day and by month.
+func (e *Engine) Usage() *accounting.Report {
+	e.updateUsage()
+	return e.Accountant.Report()
+}
+
+// updateUsage counts the traffic of connections since the previous update.
+func (e *Engine) updateUsage() {
+	now := time.Now()
+	e.Tracker.Collect(func(c conntrack.Conn, upload, download int64, isNew bool) {
+		counters := accounting.Counters{Upload: upload, Download: download}
+		if isNew {
+			counters.Flows = 1
+		}
+		e.Accountant.Add(now, c.Process, c.Route == "direct", counters)
+	})
+}
+
+func (e *Engine) account(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+			e.updateUsage()
+			if err := e.Accountant.Save(); err != nil {
+				log.Warnf("save usage failed: %v", err)
+			}
+		}
+	}
+}
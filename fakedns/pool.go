@@ -0,0 +1,160 @@
+package fakedns
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Pool hands out fake IPv4 addresses for domain names, and remembers which
+// domain each address was given for. When the pool is exhausted, the least
+// recently used address is recycled.
+type Pool struct {
+	sync.Mutex
+
+	ipNet    *net.IPNet
+	first    uint32
+	size     uint32
+	lru      *list.List // of *entry, most recently used at front
+	byIP     map[uint32]*list.Element
+	byDomain map[string]*list.Element
+	stats    PoolStats
+}
+
+// PoolStats are counters of a pool.
+type PoolStats struct {
+	// Size is the number of addresses in use and Capacity the maximum.
+	Size     int
+	Capacity int
+	// Hits and Misses count domains found in the pool or given a new
+	// address.
+	Hits   uint64
+	Misses uint64
+	// Evictions counts addresses recycled from other domains.
+	Evictions uint64
+	// Lookups and Unknown count translations of fake addresses back to
+	// domains, Unknown ones are fake addresses no longer in the pool.
+	Lookups uint64
+	Unknown uint64
+}
+
+type entry struct {
+	ip     uint32
+	domain string
+}
+
+// NewPool creates a pool of at most size addresses taken from the IPv4
+// range cidr, the network and broadcast addresses are never used.
+func NewPool(cidr string, size int) (*Pool, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip4 := ipNet.IP.To4()
+	if ip4 == nil {
+		return nil, errors.New("fake DNS pool must be an IPv4 range")
+	}
+	ones, bits := ipNet.Mask.Size()
+	available := uint64(1)<<uint(bits-ones) - 2
+	if bits-ones < 2 {
+		return nil, errors.New("fake DNS pool is too small")
+	}
+	if size <= 0 || uint64(size) > available {
+		size = int(available)
+	}
+	return &Pool{
+		ipNet:    ipNet,
+		first:    binary.BigEndian.Uint32(ip4) + 1,
+		size:     uint32(size),
+		lru:      list.New(),
+		byIP:     make(map[uint32]*list.Element),
+		byDomain: make(map[string]*list.Element),
+	}, nil
+}
+
+func toIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func canonical(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// IPForDomain returns the fake address of domain, allocating one if needed.
+func (p *Pool) IPForDomain(domain string) net.IP {
+	domain = canonical(domain)
+
+	p.Lock()
+	defer p.Unlock()
+
+	if e, ok := p.byDomain[domain]; ok {
+		p.stats.Hits++
+		p.lru.MoveToFront(e)
+		return toIP(e.Value.(*entry).ip)
+	}
+	p.stats.Misses++
+
+	var ip uint32
+	if uint32(p.lru.Len()) < p.size {
+		ip = p.first + uint32(p.lru.Len())
+	} else {
+		oldest := p.lru.Back()
+		old := oldest.Value.(*entry)
+		p.lru.Remove(oldest)
+		delete(p.byIP, old.ip)
+		delete(p.byDomain, old.domain)
+		ip = old.ip
+		p.stats.Evictions++
+	}
+	e := p.lru.PushFront(&entry{ip: ip, domain: domain})
+	p.byIP[ip] = e
+	p.byDomain[domain] = e
+	return toIP(ip)
+}
+
+// DomainForIP returns the domain ip was given for, if ip is a fake address.
+func (p *Pool) DomainForIP(ip net.IP) (string, bool) {
+	if !p.Contains(ip) {
+		return "", false
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.stats.Lookups++
+	e, ok := p.byIP[binary.BigEndian.Uint32(ip.To4())]
+	if !ok {
+		p.stats.Unknown++
+		return "", false
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*entry).domain, true
+}
+
+// Contains reports whether ip belongs to the range of the pool.
+func (p *Pool) Contains(ip net.IP) bool {
+	return ip != nil && p.ipNet.Contains(ip)
+}
+
+// Len returns the number of addresses in use.
+func (p *Pool) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.lru.Len()
+}
+
+// Stats returns the counters of the pool.
+func (p *Pool) Stats() PoolStats {
+	p.Lock()
+	defer p.Unlock()
+
+	stats := p.stats
+	stats.Size = p.lru.Len()
+	stats.Capacity = int(p.size)
+	return stats
+}
@@ -0,0 +1,118 @@
+package fakedns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/eycorsican/go-tun2socks/common/dns"
+	"github.com/eycorsican/go-tun2socks/common/log"
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+// UDP handler that answers DNS queries locally. A queries get a fake address
+// from the pool, which the TCP and UDP handlers translate back to the domain
+// name, so that the name is resolved remotely. Other queries get an empty
+// answer, so that clients fall back to A queries.
+// Note that non-DNS UDP traffic is dropped.
+type udpHandler struct {
+	pool *Pool
+}
+
+const (
+	dnsHeaderLength = 12
+	dnsMaskQr       = uint8(0x80)
+	dnsMaskOpcode   = uint8(0x78)
+	dnsMaskRa       = uint8(0x80)
+	dnsMaskRcode    = uint8(0x0F)
+	dnsTypeA        = 1
+	dnsClassIN      = 1
+	dnsTTL          = 1
+)
+
+func NewUDPHandler(pool *Pool) core.UDPConnHandler {
+	return &udpHandler{pool: pool}
+}
+
+func (h *udpHandler) Connect(conn core.UDPConn, udpAddr *net.UDPAddr) error {
+	if udpAddr == nil || udpAddr.Port != dns.COMMON_DNS_PORT {
+		return errors.New("Cannot handle non-DNS packet")
+	}
+	return nil
+}
+
+func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	resp, err := h.answer(data)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteFrom(resp, addr)
+	return err
+}
+
+// answer builds the response to the query in data. Only standard queries
+// with a single question are supported.
+func (h *udpHandler) answer(data []byte) ([]byte, error) {
+	if len(data) < dnsHeaderLength {
+		return nil, errors.New("Received malformed DNS query")
+	}
+	if data[2]&dnsMaskQr != 0 || data[2]&dnsMaskOpcode != 0 || binary.BigEndian.Uint16(data[4:6]) != 1 {
+		return nil, errors.New("Unsupported DNS query")
+	}
+	name, end, err := parseName(data, dnsHeaderLength)
+	if err != nil {
+		return nil, err
+	}
+	if end+4 > len(data) {
+		return nil, errors.New("Received malformed DNS query")
+	}
+	qtype := binary.BigEndian.Uint16(data[end : end+2])
+	qclass := binary.BigEndian.Uint16(data[end+2 : end+4])
+	end += 4
+
+	// Header and question are copied from the query, additional records
+	// such as EDNS options are dropped.
+	resp := make([]byte, end, end+16)
+	copy(resp, data[:end])
+	resp[2] |= dnsMaskQr
+	resp[3] = (resp[3] | dnsMaskRa) &^ dnsMaskRcode
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+
+	if qtype == dnsTypeA && qclass == dnsClassIN && name != "" {
+		ip := h.pool.IPForDomain(name)
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		// Pointer to the name in the question.
+		resp = append(resp, 0xC0, dnsHeaderLength)
+		resp = append(resp, 0, dnsTypeA, 0, dnsClassIN)
+		resp = append(resp, 0, 0, 0, dnsTTL)
+		resp = append(resp, 0, net.IPv4len)
+		resp = append(resp, ip.To4()...)
+		log.Debugf("fake DNS: %s -> %s", name, ip)
+	}
+	return resp, nil
+}
+
+// parseName reads the uncompressed name at offset off, and returns it with
+// the offset following it.
+func parseName(data []byte, off int) (string, int, error) {
+	var labels []string
+	for {
+		if off >= len(data) {
+			return "", 0, errors.New("Received malformed DNS query")
+		}
+		n := int(data[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n&0xC0 != 0 || off+n > len(data) {
+			return "", 0, errors.New("Received malformed DNS query")
+		}
+		labels = append(labels, string(data[off:off+n]))
+		off += n
+	}
+	return strings.Join(labels, "."), off, nil
+}
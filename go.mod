@@ -1,16 +1,12 @@
 module github.com/zinoulink/tun2ray
 
+go 1.16
+
 require (
 	github.com/eycorsican/go-tun2socks v1.16.9
-	github.com/golang/protobuf v1.4.3
-	github.com/gorilla/websocket v1.4.2 // indirect
-	github.com/refraction-networking/utls v0.0.0-20200601200209-ada0bb9b38a0 // indirect
-	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
-	golang.org/x/mobile v0.0.0-20200329125638-4c31acba0007 // indirect
-	golang.org/x/sys v0.0.0-20201231184435-2d18734c6014
-	v2ray.com/core v4.19.1+incompatible
+	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
+	github.com/v2fly/v2ray-core/v4 v4.36.2
+	golang.org/x/sys v0.0.0-20210305230114-8fe3ee5dd75b
+	google.golang.org/grpc v1.36.0
+	gopkg.in/yaml.v2 v2.3.0
 )
-
-replace v2ray.com/core => github.com/v2fly/v2ray-core v4.34.0+incompatible
-
-go 1.15
@@ -9,7 +9,9 @@ import (
 	"strings"
 )
 
-func GetCommandNameBySocket(network string, addr string, port uint16) (string, error) {
+// GetProcessBySocket returns the command name and the executable path of
+// the process owning the socket, the path is empty if it is not found.
+func GetProcessBySocket(network string, addr string, port uint16) (string, string, error) {
 	pattern := ""
 	switch network {
 	case "tcp":
@@ -25,21 +27,43 @@ func GetCommandNameBySocket(network string, addr string, port uint16) (string, e
 		pattern = fmt.Sprintf("-i%s:%d", network, port)
 	default:
 	}
-	out, err := exec.Command("lsof", "-n", "-Fc", pattern).Output()
+	out, err := exec.Command("lsof", "-n", "-Fpc", pattern).Output()
 	if err != nil {
 		if len(out) != 0 {
-			return "", errors.New(fmt.Sprintf("%v, output: %s", err, out))
+			return "", "", errors.New(fmt.Sprintf("%v, output: %s", err, out))
 		}
-		return "", err
+		return "", "", err
 	}
+	pid := ""
 	lines := strings.Split(string(out), "\n")
 	for _, line := range lines {
 		// There may be multiple candidate
 		// sockets in the list, just take
 		// the first one for simplicity.
+		if strings.HasPrefix(line, "p") && pid == "" {
+			pid = line[1:]
+		}
 		if strings.HasPrefix(line, "c") {
-			return line[1:len(line)], nil
+			return line[1:len(line)], executablePath(pid), nil
+		}
+	}
+	return "", "", errors.New("not found")
+}
+
+// executablePath returns the path of the program text of pid, the first
+// txt file listed by lsof.
+func executablePath(pid string) string {
+	if pid == "" {
+		return ""
+	}
+	out, err := exec.Command("lsof", "-n", "-a", "-p", pid, "-d", "txt", "-Fn").Output()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "n") {
+			return line[1:]
 		}
 	}
-	return "", errors.New("not found")
+	return ""
 }
@@ -7,6 +7,6 @@ import (
 	"errors"
 )
 
-func GetCommandNameBySocket(network string, addr string, port uint16) (string, error) {
-	return "", errors.New("not implemented")
+func GetProcessBySocket(network string, addr string, port uint16) (string, string, error) {
+	return "", "", errors.New("not implemented")
 }
@@ -11,20 +11,22 @@ import (
 	win "github.com/zinoulink/tun2ray/lsof/windows"
 )
 
-func GetCommandNameBySocket(network string, addr string, port uint16) (string, error) {
+// GetProcessBySocket returns the module name and the executable path of
+// the process owning the socket.
+func GetProcessBySocket(network string, addr string, port uint16) (string, string, error) {
 	switch network {
 	case "tcp":
 		tcpTable, err := getTcpTable()
 		if err != nil {
-			return "", fmt.Errorf("failed to get TCP table: %v", err)
+			return "", "", fmt.Errorf("failed to get TCP table: %v", err)
 		}
 		for i := 0; i < int(tcpTable.NumEntries); i++ {
 			row := tcpTable.Table[i]
 			if win.NTOHS(uint16(row.LocalPort)) == port /* && win.IPAddrNTOA(uint32(row.LocalAddr)) == addr */ {
-				return getNameByPid(uint32(row.OwningPid))
+				return getProcessByPid(uint32(row.OwningPid))
 			}
 		}
-		return "", errors.New("not found")
+		return "", "", errors.New("not found")
 	case "udp":
 		var udpTable win.MIB_UDPTABLE_OWNER_PID
 		err := getUdpTable(
@@ -32,12 +34,12 @@ func GetCommandNameBySocket(network string, addr string, port uint16) (string, e
 			win.AF_INET,
 		)
 		if err != nil {
-			return "", fmt.Errorf("failed to get UDP table: %v", err)
+			return "", "", fmt.Errorf("failed to get UDP table: %v", err)
 		}
 		for i := 0; i < int(udpTable.NumEntries); i++ {
 			row := udpTable.Table[i]
 			if win.NTOHS(uint16(row.LocalPort)) == port /* && win.IPAddrNTOA(uint32(row.LocalAddr)) == addr */ {
-				return getNameByPid(uint32(row.OwningPid))
+				return getProcessByPid(uint32(row.OwningPid))
 			}
 		}
 
@@ -56,19 +58,21 @@ func GetCommandNameBySocket(network string, addr string, port uint16) (string, e
 		// 	}
 		// }
 
-		return "", errors.New("not found")
+		return "", "", errors.New("not found")
 	default:
-		return "", errors.New("not found")
+		return "", "", errors.New("not found")
 	}
 }
 
-func getNameByPid(pid uint32) (string, error) {
+// getProcessByPid returns the name and the path of the first module of
+// pid, its executable.
+func getProcessByPid(pid uint32) (string, string, error) {
 	handle := win.CreateToolhelp32Snapshot(
 		win.TH32CS_SNAPMODULE,
 		pid,
 	)
 	if handle <= 0 {
-		return "", fmt.Errorf("failed to create snapshot: %v", handle)
+		return "", "", fmt.Errorf("failed to create snapshot: %v", handle)
 	}
 	defer win.CloseHandle(handle)
 
@@ -76,9 +80,9 @@ func getNameByPid(pid uint32) (string, error) {
 	me.Size = uint32(unsafe.Sizeof(me))
 	success := win.Module32First(handle, &me)
 	if success {
-		return win.UTF16PtrToString(&me.Module[0]), nil
+		return win.UTF16PtrToString(&me.Module[0]), win.UTF16PtrToString(&me.ExePath[0]), nil
 	} else {
-		return "", fmt.Errorf("failed to get process entry: %v", syscall.GetLastError())
+		return "", "", fmt.Errorf("failed to get process entry: %v", syscall.GetLastError())
 	}
 }
 
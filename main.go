@@ -1,27 +1,25 @@
 package main
 
 import (
-	"context"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/zinoulink/tun2ray/api"
+	"github.com/zinoulink/tun2ray/conntrack"
 	"github.com/zinoulink/tun2ray/d"
-	"github.com/zinoulink/tun2ray/v2ray"
-	vcore "v2ray.com/core"
-	vproxyman "v2ray.com/core/app/proxyman"
-	vbytespool "v2ray.com/core/common/bytespool"
-	"v2ray.com/core/common/session"
+	"github.com/zinoulink/tun2ray/engine"
+	"github.com/zinoulink/tun2ray/tun"
 
 	"github.com/eycorsican/go-tun2socks/core"
-	"github.com/eycorsican/go-tun2socks/tun"
 )
 
 type cmdArgs struct {
@@ -30,12 +28,30 @@ type cmdArgs struct {
 	TunGw                *string
 	TunMask              *string
 	TunDNS               *string
+	TunQueues            *int
 	Config               *string
 	SniffingType         *string
+	SniffTimeout         *time.Duration
 	UDPTimeout           *time.Duration
+	UDPPortTimeouts      *string
+	UDPPolicyLevel       *int
+	MaxUDPSessions       *int
+	TCPHalfOpenTimeout   *time.Duration
 	DNSFallback          *bool
 	ExceptionApps        *string
+	ExceptionOutbounds   *string
+	RulesFile            *string
+	BypassPrivate        *bool
+	BypassCIDRs          *string
+	BypassPorts          *string
+	BypassDomains        *string
+	Blocklists           *string
+	Allowlists           *string
 	ExceptionSendThrough *string
+	API                  *string
+	APIToken             *string
+	UsageFile            *string
+	InboundTag           *string
 }
 
 const (
@@ -51,20 +67,35 @@ func main() {
 	args.TunGw = flag.String("tunGw", "10.0.89.1", "TUN interface gateway")
 	args.TunMask = flag.String("tunMask", "255.255.255.0", "TUN interface netmask, it should be a prefixlen (a number) for IPv6 address")
 	args.TunDNS = flag.String("tunDns", "114.114.114.114", "DNS resolvers for TUN interface (only need on Windows)")
+	args.TunQueues = flag.Int("tunQueues", 1, "Number of queues of the TUN device, each read by its own goroutine (only on Linux, more than one needs a multi-queue device)")
 	args.Config = flag.String("config", "config.json", "Config file for v2ray, in JSON format, and note that routing in v2ray could not violate routes in the routing table")
 	args.SniffingType = flag.String("sniffingType", "http,tls", "Enable domain sniffing for specific kind of traffic in v2ray")
+	args.SniffTimeout = flag.Duration("sniffTimeout", 200*time.Millisecond, "How long to wait for the first bytes of TCP connections to sniff their domain for bypass domains and rules, 0 disables it")
+	args.UDPTimeout = flag.Duration("udpTimeout", 1*time.Minute, "UDP session timeout")
+	args.UDPPortTimeouts = flag.String("udpPortTimeouts", "53=10s", "UDP session timeouts by destination port or port range, as port=timeout pairs separated by commas, e.g. 53=10s,27015-27030=10m")
+	args.UDPPolicyLevel = flag.Int("udpPolicyLevel", -1, "V2Ray policy level whose connIdle timeout is used for UDP sessions sent to V2Ray, -1 ignores V2Ray policies")
+	args.TCPHalfOpenTimeout = flag.Duration("tcpHalfOpenTimeout", 1*time.Minute, "How long TCP connections closed by one side are kept open without data, 0 waits forever")
+	args.MaxUDPSessions = flag.Int("maxUdpSessions", 4096, "Maximum number of UDP sessions, the least recently active ones are closed past it, 0 is unlimited")
 	args.ExceptionApps = flag.String("exceptionApps", "tun2ray.exe", "Exception app list separated by commas")
+	args.ExceptionOutbounds = flag.String("exceptionOutbounds", "", "Apps sent to a V2Ray outbound, as app=tag pairs separated by commas, e.g. steam=direct-jp,git=proxy-us, the tag can also be block or drop")
+	args.RulesFile = flag.String("rules", "", "Routing rules file, in YAML or JSON if its name ends with .json, evaluated before exception apps")
+	args.BypassPrivate = flag.Bool("bypassPrivate", false, "Send connections to loopback, private, link-local and multicast addresses direct")
+	args.BypassCIDRs = flag.String("bypassCidrs", "", "Destination CIDRs sent direct, separated by commas, e.g. 10.1.0.0/16,172.20.1.5")
+	args.BypassPorts = flag.String("bypassPorts", "", "Destination ports sent direct, separated by commas, e.g. 22,3389,8000-9000")
+	args.BypassDomains = flag.String("bypassDomains", "", "Destination domains sent direct with their subdomains, separated by commas")
+	args.Blocklists = flag.String("blocklists", "", "Domain blocklist files in the hosts, AdBlock or one domain per line format, separated by commas")
+	args.Allowlists = flag.String("allowlists", "", "Files of domains never blocked, in the same formats as blocklists, separated by commas")
 	args.ExceptionSendThrough = flag.String("sendThrough", "192.168.1.3:0", "Exception send through address")
+	args.API = flag.String("api", "", "Listen address of the management API, either unix:/path/to/socket or a local TCP address, disabled if empty")
+	args.APIToken = flag.String("apiToken", "", "Bearer token required by the management API")
+	args.InboundTag = flag.String("inboundTag", "tun", "Inbound tag of TUN traffic in V2Ray routing rules")
+	args.UsageFile = flag.String("usageFile", "", "JSON file where per-app traffic usage is saved, kept in memory only if empty")
 
 	flag.Parse()
 
-	if args.UDPTimeout == nil {
-		args.UDPTimeout = flag.Duration("udpTimeout", 1*time.Minute, "UDP session timeout")
-	}
-
 	// Open the tun device.
 	dnsServers := strings.Split(*args.TunDNS, ",")
-	tunDev, err := tun.OpenTunDevice(*args.TunName, *args.TunAddr, *args.TunGw, *args.TunMask, dnsServers, false)
+	tunQueues, err := tun.OpenTunDeviceQueues(*args.TunName, *args.TunAddr, *args.TunGw, *args.TunMask, dnsServers, false, *args.TunQueues)
 	if err != nil {
 		log.Fatalf("failed to open tun device: %v", err)
 	}
@@ -72,92 +103,185 @@ func main() {
 	// Setup TCP/IP stack.
 	lwipWriter := core.NewLWIPStack().(io.Writer)
 
-	startV2Ray(*args.Config, *args.SniffingType, *args.ExceptionApps, *args.ExceptionSendThrough)
+	b := startV2Ray(*args.Config, *args.SniffingType, *args.ExceptionApps, *args.ExceptionSendThrough)
+
+	// Start the management API.
+	if *args.API != "" {
+		server := api.NewServer(b, *args.APIToken)
+		if err := server.Listen(*args.API); err != nil {
+			log.Fatalf("failed to start API: %v", err)
+		}
+		defer server.Close()
+	}
 
 	// Register an output callback to write packets output from lwip stack to tun
 	// device, output function should be set before input any packets.
 	core.RegisterOutputFn(func(data []byte) (int, error) {
-		return tunDev.Write(data)
+		n, err := tunQueues.Write(data)
+		engine.Tun.Written(n)
+		return n, err
 	})
 
-	// Copy packets from tun device to lwip stack, it's the main loop.
-	go func() {
-		_, err := io.CopyBuffer(lwipWriter, tunDev, make([]byte, MTU))
-		if err != nil {
-			log.Fatalf("copying data failed: %v", err)
-		}
-	}()
+	// Copy packets from each queue of the tun device to lwip stack, they are
+	// the main loops. The stack takes packets from several goroutines.
+	for _, queue := range tunQueues {
+		go func(queue io.Reader) {
+			_, err := io.CopyBuffer(lwipWriter, engine.Tun.Reader(queue), make([]byte, MTU))
+			if err != nil {
+				log.Fatalf("copying data failed: %v", err)
+			}
+		}(queue)
+	}
 
 	log.Println("Running tun2ray")
 	osSignals := make(chan os.Signal, 1)
 	signal.Notify(osSignals, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
 	<-osSignals
+
+	// Close the engine to save usage.
+	if err := b.Close(); err != nil {
+		log.Printf("failed to close engine: %v", err)
+	}
+}
+
+// backend runs the engine, it implements api.Backend.
+type backend struct {
+	sync.Mutex
+
+	configFile string
+	config     []byte // last config the engine started with
+	opts       *engine.Options
+	engine     *engine.Engine
+	closed     bool // engine is closed, a reload failed to restart one
 }
 
-func startV2Ray(configFile string, sniffingType string, exceptionApps string, exceptionSendThrough string) {
+func (b *backend) Engine() *engine.Engine {
+	b.Lock()
+	defer b.Unlock()
+	return b.engine
+}
 
-	// Share the buffer pool.
-	core.SetBufferPool(vbytespool.GetPool(core.BufSize))
+// Reload restarts the engine with the config file. The previous engine is
+// closed first, as V2Ray inbounds can't listen twice on the same port, and
+// restarted with the previous config if the new one fails. If that fails
+// too, tun2ray keeps running without a working engine until a reload
+// succeeds.
+func (b *backend) Reload() error {
+	b.Lock()
+	defer b.Unlock()
 
-	// Read config file
-	configBytes, err := ioutil.ReadFile(*args.Config)
+	configBytes, err := ioutil.ReadFile(b.configFile)
 	if err != nil {
-		log.Fatalf("invalid vconfig file")
+		return err
 	}
 
-	// Start the V2Ray instance.
-	v, err := vcore.StartInstance("json", configBytes)
-	if err != nil {
-		log.Fatalf("start V instance failed: %v", err)
+	old := b.engine
+	exceptions := old.ExceptionOptions()
+	rules := old.RuleConfigs()
+	logLevel := old.LogLevel()
+	if !b.closed {
+		if err := old.Close(); err != nil {
+			log.Printf("failed to close engine: %v", err)
+		}
+		b.closed = true
 	}
 
-	// Configure sniffing settings for traffic coming from tun2socks.
-	var validSniffings []string
-	sniffings := strings.Split(sniffingType, ",")
-	for _, s := range sniffings {
-		if s == "http" || s == "tls" {
-			validSniffings = append(validSniffings, s)
+	e, err := engine.New(configBytes, b.opts, d.LsofLookup)
+	if err != nil {
+		e, restartErr := engine.New(b.config, b.opts, d.LsofLookup)
+		if restartErr != nil {
+			log.Printf("failed to restart engine, connections fail until a reload succeeds: %v", restartErr)
+			return fmt.Errorf("%v, restarting the previous config failed too: %v", err, restartErr)
 		}
+		b.setEngine(e, exceptions, rules, logLevel)
+		return err
 	}
-	sniffingConfig := &vproxyman.SniffingConfig{
-		Enabled:             true,
-		DestinationOverride: validSniffings,
+	b.config = configBytes
+	b.setEngine(e, exceptions, rules, logLevel)
+	log.Println("Reloaded tun2ray")
+	return nil
+}
+
+// setEngine registers e, keeping settings changed through the API. Rules
+// are read from the rules file again if there is one.
+func (b *backend) setEngine(e *engine.Engine, exceptions engine.ExceptionOptions, rules []d.RuleConfig, logLevel string) {
+	if err := e.SetExceptionOptions(exceptions); err != nil {
+		log.Printf("keeping exceptions of the command line: %v", err)
 	}
-	if len(validSniffings) == 0 {
-		sniffingConfig.Enabled = false
+	if b.opts.RulesFile == "" {
+		if err := e.SetRules(rules); err != nil {
+			log.Printf("dropping rules: %v", err)
+		}
+	}
+	e.SetLogLevel(logLevel)
+	e.Register()
+	b.engine = e
+	b.closed = false
+}
+
+// Close closes the engine, unless a failed reload left it closed.
+func (b *backend) Close() error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return nil
 	}
-	ctx := ContextWithSniffingConfig(context.Background(), sniffingConfig)
+	b.closed = true
+	return b.engine.Close()
+}
 
-	// Create v2ray handlers.
-	v2rayTCPConnHandler := v2ray.NewTCPHandler(ctx, v)
-	v2rayUDPConnHandler := v2ray.NewUDPHandler(ctx, v, *args.UDPTimeout)
+func startV2Ray(configFile string, sniffingType string, exceptionApps string, exceptionSendThrough string) *backend {
 
-	// Resolve the gateway address.
-	sendThrough, err := net.ResolveTCPAddr("tcp", exceptionSendThrough)
+	// Read config file
+	configBytes, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		log.Fatalf("invalid exception send through address: %v", err)
+		log.Fatalf("invalid vconfig file")
 	}
-	// Prepare the apps list.
-	apps := strings.Split(exceptionApps, ",")
 
-	// Create d handlers
-	tcpHandler := d.NewTCPHandler(v2rayTCPConnHandler, apps, sendThrough)
-	udpHandler := d.NewUDPHandler(v2rayUDPConnHandler, apps, sendThrough, *args.UDPTimeout)
+	opts := engine.DefaultOptions()
+	opts.Sniffing = strings.Split(sniffingType, ",")
+	opts.SniffTimeout = engine.Duration(*args.SniffTimeout)
+	opts.UDPTimeout = engine.Duration(*args.UDPTimeout)
+	portTimeouts, err := conntrack.ParsePortTimeouts(*args.UDPPortTimeouts)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	opts.UDPPortTimeouts = make(map[string]engine.Duration, len(portTimeouts))
+	for port, timeout := range portTimeouts {
+		opts.UDPPortTimeouts[port] = engine.Duration(timeout)
+	}
+	opts.UDPPolicyLevel = *args.UDPPolicyLevel
+	opts.MaxUDPSessions = *args.MaxUDPSessions
+	opts.TCPHalfOpenTimeout = engine.Duration(*args.TCPHalfOpenTimeout)
+	opts.InboundTag = *args.InboundTag
+	opts.Exceptions.Direct = d.SplitList(exceptionApps)
+	opts.RulesFile = *args.RulesFile
+	opts.Exceptions.Outbounds, err = d.ParseOutbounds(*args.ExceptionOutbounds)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	opts.Exceptions.SendThrough = exceptionSendThrough
+	opts.Bypass.Private = *args.BypassPrivate
+	opts.Bypass.CIDRs = d.SplitList(*args.BypassCIDRs)
+	opts.Bypass.Ports = d.SplitList(*args.BypassPorts)
+	opts.Bypass.Domains = d.SplitList(*args.BypassDomains)
+	opts.Blocklist.Files = d.SplitList(*args.Blocklists)
+	opts.Blocklist.AllowFiles = d.SplitList(*args.Allowlists)
+	opts.Accounting.File = *args.UsageFile
 
-	// Register tun2socks connection handlers.
-	core.RegisterTCPConnHandler(tcpHandler)
-	core.RegisterUDPConnHandler(udpHandler)
-}
+	// Start the V2Ray instance and create the handlers.
+	e, err := engine.New(configBytes, opts, d.LsofLookup)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
-// ContextWithSniffingConfig is a wrapper of session.ContextWithContent.
-// Deprecated. Use session.ContextWithContent directly.
-func ContextWithSniffingConfig(ctx context.Context, c *vproxyman.SniffingConfig) context.Context {
-	content := session.ContentFromContext(ctx)
-	if content == nil {
-		content = new(session.Content)
-		ctx = session.ContextWithContent(ctx, content)
-	}
-	content.SniffingRequest.Enabled = c.Enabled
-	content.SniffingRequest.OverrideDestinationForProtocol = c.DestinationOverride
-	return ctx
+	// Register tun2socks connection handlers.
+	e.Register()
+	return &backend{
+		configFile: configFile,
+		config:     configBytes,
+		opts:       opts,
+		engine:     e,
+	}
 }
@@ -0,0 +1,149 @@
+// Package metrics writes metrics in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	sync.Mutex
+
+	bounds []float64 // upper bounds, increasing
+	counts []uint64  // per bucket, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram returns a histogram with buckets of the given upper bounds.
+func NewHistogram(bounds ...float64) *Histogram {
+	sort.Float64s(bounds)
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe adds value to the histogram.
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+
+	h.Lock()
+	defer h.Unlock()
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// ObserveSince adds the seconds elapsed since start to the histogram.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Writer writes metrics, the first error is kept and returned by Flush.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Header writes the help and type lines of a metric, typ is one of
+// "counter", "gauge", "histogram" and "untyped".
+func (w *Writer) Header(name, typ, help string) {
+	w.write("# HELP ", name, " ", escapeHelp(help), "\n")
+	w.write("# TYPE ", name, " ", typ, "\n")
+}
+
+// Sample writes a sample of name, labels are pairs of label names and
+// values.
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.write(name, formatLabels(labels), " ", formatValue(value), "\n")
+}
+
+// Histogram writes h as name, with its header.
+func (w *Writer) Histogram(name, help string, h *Histogram) {
+	h.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.Unlock()
+
+	w.Header(name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		w.Sample(name+"_bucket", float64(cumulative), "le", formatValue(bound))
+	}
+	w.Sample(name+"_bucket", float64(count), "le", "+Inf")
+	w.Sample(name+"_sum", sum)
+	w.Sample(name+"_count", float64(count))
+}
+
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) write(parts ...string) {
+	for _, p := range parts {
+		if w.err != nil {
+			return
+		}
+		_, w.err = w.w.WriteString(p)
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
@@ -0,0 +1,4 @@
+package relay
+
+// spliceSupported is true as ReadFrom of TCP sockets splices on Linux.
+const spliceSupported = true
@@ -0,0 +1,7 @@
+// +build !linux
+
+package relay
+
+// spliceSupported is false as ReadFrom of TCP sockets copies through a
+// buffer it allocates on other systems.
+const spliceSupported = false
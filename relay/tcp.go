@@ -0,0 +1,200 @@
+// Package relay copies data between the app side and the remote side of
+// connections.
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+)
+
+// bufSize is the size of the buffers of relays that can't splice, the one
+// io.Copy allocates.
+const bufSize = 32 * 1024
+
+// bufPool holds the buffers of relays that can't splice, shared rather than
+// allocated for each direction of each connection.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, bufSize)
+		return &b
+	},
+}
+
+// CloseWriter is implemented by conns able to shut down their write side,
+// such as *net.TCPConn and the tun2socks conns.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// CloseReader is implemented by conns able to shut down their read side.
+type CloseReader interface {
+	CloseRead() error
+}
+
+// NetConner is implemented by conns wrapping another one, such as the
+// tracked conns, so that data can be spliced between the sockets below.
+type NetConner interface {
+	NetConn() net.Conn
+}
+
+// tcpSocket returns the TCP socket conn is or wraps, nil if there is none.
+func tcpSocket(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case NetConner:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+type tcpRelay struct {
+	lastActive int64 // unix nanoseconds, accessed atomically
+	// tick is how often spliced data is noticed as activity, zero if
+	// activity doesn't matter.
+	tick time.Duration
+}
+
+type copyResult struct {
+	reason string
+	// halfClosed is true if the source was at EOF and the write side of
+	// the destination was shut down, the other direction goes on.
+	halfClosed bool
+}
+
+func (r *tcpRelay) active() {
+	atomic.StoreInt64(&r.lastActive, time.Now().UnixNano())
+}
+
+// TCP copies data between lhs, the conn from the app, and rhs, the conn to
+// the remote, until both directions are done, then closes both. When one
+// side shuts down its write side, the write side of the other is shut down
+// if it is a CloseWriter, so that the other direction goes on. Otherwise,
+// or if a copy fails, both are closed. A half-closed connection is closed
+// once idle for halfOpenTimeout, zero waits forever, as the tun2socks conns
+// ignore deadlines. The close reason is set on the flow of lhs.
+func TCP(lhs, rhs net.Conn, halfOpenTimeout time.Duration) {
+	r := &tcpRelay{lastActive: time.Now().UnixNano()}
+	if halfOpenTimeout > 0 {
+		// Often enough that an active connection is never idle for
+		// halfOpenTimeout.
+		r.tick = halfOpenTimeout / 8
+	}
+	// Buffered so that the copies never block once the relay is over.
+	results := make(chan copyResult, 2)
+	// Spliced bytes don't go through the tracked conn.
+	upload, download := func(int) {}, func(int) {}
+	if f := conntrack.FlowOf(lhs); f != nil {
+		upload, download = f.AddUpload, f.AddDownload
+	}
+	go r.copy(rhs, lhs, "local closed", upload, results)
+	go r.copy(lhs, rhs, "remote closed", download, results)
+
+	first := <-results
+	reason := first.reason
+	if first.halfClosed {
+		if !r.waitOther(results, halfOpenTimeout) {
+			reason = "idle timeout"
+		}
+	}
+	if f := conntrack.FlowOf(lhs); f != nil {
+		f.SetCloseReason(reason)
+	}
+	rhs.Close()
+	lhs.Close()
+}
+
+// waitOther waits for the direction still going, it reports false if it
+// was idle for timeout first.
+func (r *tcpRelay) waitOther(results <-chan copyResult, timeout time.Duration) bool {
+	if timeout <= 0 {
+		<-results
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-results:
+			return true
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&r.lastActive)))
+			if idle >= timeout {
+				return false
+			}
+			timer.Reset(timeout - idle)
+		}
+	}
+}
+
+func (r *tcpRelay) copy(dst, src net.Conn, reason string, count func(int), results chan<- copyResult) {
+	err := r.transfer(dst, src, count)
+	halfClosed := false
+	if err == nil {
+		if cw, ok := dst.(CloseWriter); ok {
+			halfClosed = cw.CloseWrite() == nil
+		}
+		if cr, ok := src.(CloseReader); ok {
+			cr.CloseRead()
+		}
+	}
+	results <- copyResult{reason, halfClosed}
+}
+
+// transfer copies from src to dst until EOF. Between two TCP sockets, the
+// data is spliced if the system supports it, and count is called with the
+// bytes moved. Otherwise it is copied through a pooled buffer.
+func (r *tcpRelay) transfer(dst, src net.Conn, count func(int)) error {
+	if spliceSupported {
+		if dstSocket, srcSocket := tcpSocket(dst), tcpSocket(src); dstSocket != nil && srcSocket != nil {
+			return r.splice(dstSocket, srcSocket, count)
+		}
+	}
+
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	for {
+		n, err := src.Read(*buf)
+		if n > 0 {
+			r.active()
+			if _, err := dst.Write((*buf)[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// splice moves data from src to dst until EOF with ReadFrom, which splices
+// between TCP sockets. The read deadline of src makes ReadFrom return every
+// tick, so that the bytes moved are seen as activity.
+func (r *tcpRelay) splice(dst, src *net.TCPConn, count func(int)) error {
+	for {
+		if r.tick > 0 {
+			src.SetReadDeadline(time.Now().Add(r.tick))
+		}
+		n, err := dst.ReadFrom(src)
+		if n > 0 {
+			r.active()
+			count(int(n))
+		}
+		if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+	}
+}
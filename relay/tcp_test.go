@@ -0,0 +1,347 @@
+package relay
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+)
+
+// server runs handle for each conn accepted.
+func server(tb testing.TB, handle func(c *net.TCPConn)) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c.(*net.TCPConn))
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// pair returns the app end and the relay end of a local connection.
+func pair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	app, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	c, err := l.AcceptTCP()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return app, c
+}
+
+// relayTo relays a local connection to remote, it returns the app end and
+// a channel closed when the relay is over.
+func relayTo(t *testing.T, remote *net.TCPAddr, timeout time.Duration) (*net.TCPConn, chan struct{}) {
+	app, lhs := pair(t)
+	rhs, err := net.DialTCP("tcp", nil, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		TCP(lhs, rhs, timeout)
+		close(done)
+	}()
+	return app, done
+}
+
+func waitDone(t *testing.T, done chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay not over")
+	}
+}
+
+// The app closes its write side, the echo server gets EOF once it echoed
+// everything, and the echo still reaches the app.
+func TestEchoHalfClose(t *testing.T) {
+	remote := server(t, func(c *net.TCPConn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	app, done := relayTo(t, remote, time.Minute)
+	app.Write([]byte("hello"))
+	app.CloseWrite()
+	got, err := ioutil.ReadAll(app)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	waitDone(t, done)
+}
+
+// The server only replies once it got EOF.
+func TestAppHalfClose(t *testing.T) {
+	remote := server(t, func(c *net.TCPConn) {
+		data, _ := ioutil.ReadAll(c)
+		c.Write(append([]byte("echo "), data...))
+		c.Close()
+	})
+	app, done := relayTo(t, remote, time.Minute)
+	app.Write([]byte("hello"))
+	app.CloseWrite()
+	got, err := ioutil.ReadAll(app)
+	if err != nil || string(got) != "echo hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	waitDone(t, done)
+}
+
+// The server closes its write side first and keeps reading.
+func TestRemoteHalfClose(t *testing.T) {
+	got := make(chan string, 1)
+	remote := server(t, func(c *net.TCPConn) {
+		c.Write([]byte("banner"))
+		c.CloseWrite()
+		data, _ := ioutil.ReadAll(c)
+		got <- string(data)
+		c.Close()
+	})
+	app, done := relayTo(t, remote, time.Minute)
+	banner, err := ioutil.ReadAll(app)
+	if err != nil || string(banner) != "banner" {
+		t.Fatalf("got %q, %v", banner, err)
+	}
+	app.Write([]byte("late data"))
+	app.CloseWrite()
+	if s := <-got; s != "late data" {
+		t.Fatalf("got %q", s)
+	}
+	waitDone(t, done)
+}
+
+// A half-open connection without data is closed after the timeout, data
+// in the meantime delays it.
+func TestHalfOpenTimeout(t *testing.T) {
+	remote := server(t, func(c *net.TCPConn) {
+		io.Copy(ioutil.Discard, c)
+		// Never replies nor closes.
+		time.Sleep(5 * time.Second)
+		c.Close()
+	})
+	app, done := relayTo(t, remote, 300*time.Millisecond)
+	app.CloseWrite()
+	start := time.Now()
+	waitDone(t, done)
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Fatalf("closed after %v", d)
+	}
+
+	remote = server(t, func(c *net.TCPConn) {
+		io.Copy(ioutil.Discard, c)
+		for i := 0; i < 6; i++ {
+			c.Write([]byte("tick"))
+			time.Sleep(100 * time.Millisecond)
+		}
+		c.Close()
+	})
+	app, done = relayTo(t, remote, 300*time.Millisecond)
+	app.CloseWrite()
+	data, _ := ioutil.ReadAll(app)
+	if len(data) != 24 {
+		t.Fatalf("got %q", data)
+	}
+	waitDone(t, done)
+}
+
+// plainConn hides the CloseWrite and CloseRead methods of a conn.
+type plainConn struct{ net.Conn }
+
+// Without half-close support, both sides are closed.
+func TestNoHalfClose(t *testing.T) {
+	remote := server(t, func(c *net.TCPConn) {
+		data, _ := ioutil.ReadAll(c)
+		c.Write(data)
+		c.Close()
+	})
+	app, lhs := pair(t)
+	rhs, err := net.DialTCP("tcp", nil, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		TCP(lhs, plainConn{rhs}, time.Minute)
+		close(done)
+	}()
+	app.Write([]byte("x"))
+	app.CloseWrite()
+	waitDone(t, done)
+}
+
+// trackedHandler relays tracked connections to remote.
+type trackedHandler struct {
+	remote *net.TCPAddr
+	done   chan struct{}
+}
+
+func (h *trackedHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
+	rhs, err := net.DialTCP("tcp", nil, h.remote)
+	if err != nil {
+		return err
+	}
+	go func() {
+		TCP(conn, rhs, time.Minute)
+		close(h.done)
+	}()
+	return nil
+}
+
+// Bytes spliced around a tracked conn are counted on its flow.
+func TestTrackedCounts(t *testing.T) {
+	remote := server(t, func(c *net.TCPConn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	tracker := conntrack.NewTracker(time.Minute, nil)
+	h := &trackedHandler{remote: remote, done: make(chan struct{})}
+	app, lhs := pair(t)
+	if err := conntrack.NewTCPHandler(h, tracker).Handle(lhs, remote); err != nil {
+		t.Fatal(err)
+	}
+	app.Write([]byte("hello"))
+	app.CloseWrite()
+	got, err := ioutil.ReadAll(app)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	waitDone(t, h.done)
+	closed := tracker.Closed()
+	if len(closed) != 1 {
+		t.Fatalf("%d flows closed", len(closed))
+	}
+	if c := closed[0].Snapshot(); c.Upload != 5 || c.Download != 5 {
+		t.Fatalf("counted %d up and %d down", c.Upload, c.Download)
+	}
+}
+
+// Conns that are not TCP sockets are relayed through a buffer.
+func TestBuffered(t *testing.T) {
+	remote := server(t, func(c *net.TCPConn) {
+		io.Copy(c, c)
+		c.Close()
+	})
+	app, lhs := pair(t)
+	rhs, err := net.DialTCP("tcp", nil, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		TCP(plainConn{lhs}, plainConn{rhs}, time.Minute)
+		close(done)
+	}()
+	msg := make([]byte, 3*bufSize)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go app.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(app, got); err != nil || string(got) != string(msg) {
+		t.Fatalf("echo differs, %v", err)
+	}
+	app.Close()
+	waitDone(t, done)
+}
+
+// benchStream measures the throughput of a relay between two local
+// connections, in 1 MB steps of a single stream.
+func benchStream(b *testing.B, relay func(lhs, rhs net.Conn)) {
+	const step = 1 << 20
+	src, lhs := pair(b)
+	rhs, sink := pair(b)
+	go relay(lhs, rhs)
+	received := make(chan int64)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, sink)
+		received <- n
+	}()
+	buf := make([]byte, 64*1024)
+	b.SetBytes(step)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for n := 0; n < step; n += len(buf) {
+			if _, err := src.Write(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	src.CloseWrite()
+	if n := <-received; n != int64(b.N)*step {
+		b.Fatalf("received %d bytes", n)
+	}
+	b.StopTimer()
+	src.Close()
+	sink.Close()
+}
+
+// benchConns measures relays of new connections, each with a 16 KB
+// request and reply.
+func benchConns(b *testing.B, relay func(lhs, rhs net.Conn)) {
+	msg := make([]byte, 16*1024)
+	b.SetBytes(int64(2 * len(msg)))
+	b.ReportAllocs()
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		src, lhs := pair(b)
+		rhs, sink := pair(b)
+		b.StartTimer()
+		go relay(lhs, rhs)
+		src.Write(msg)
+		io.ReadFull(sink, msg)
+		sink.Write(msg)
+		io.ReadFull(src, msg)
+		b.StopTimer()
+		src.Close()
+		sink.Close()
+	}
+}
+
+// ioCopy is the relay before buffers were pooled. One side was a tun2socks
+// conn, so io.Copy allocated a 32 KB buffer for each direction, as it does
+// here with plainConn hiding ReadFrom and WriteTo.
+func ioCopy(lhs, rhs net.Conn) {
+	go func() {
+		io.Copy(plainConn{lhs}, plainConn{rhs})
+		lhs.Close()
+	}()
+	io.Copy(plainConn{rhs}, plainConn{lhs})
+	rhs.(*net.TCPConn).CloseWrite()
+}
+
+// pooled relays through pooled buffers, as when one side is a tun2socks
+// conn.
+func pooled(lhs, rhs net.Conn) {
+	TCP(plainConn{lhs}, plainConn{rhs}, time.Minute)
+}
+
+// spliced relays between the two sockets.
+func spliced(lhs, rhs net.Conn) {
+	TCP(lhs, rhs, time.Minute)
+}
+
+func BenchmarkStreamIOCopy(b *testing.B)  { benchStream(b, ioCopy) }
+func BenchmarkStreamPooled(b *testing.B)  { benchStream(b, pooled) }
+func BenchmarkStreamSpliced(b *testing.B) { benchStream(b, spliced) }
+func BenchmarkConnsIOCopy(b *testing.B)   { benchConns(b, ioCopy) }
+func BenchmarkConnsPooled(b *testing.B)   { benchConns(b, pooled) }
+func BenchmarkConnsSpliced(b *testing.B)  { benchConns(b, spliced) }
@@ -0,0 +1,141 @@
+// +build linux
+
+// Command bench measures how many packets per second are read from a TUN
+// device, with one reader goroutine per queue, and written to the lwIP
+// stack with -stack. UDP packets are sent to the device by local sockets,
+// on as many flows as senders so that the kernel spreads them over the
+// queues. It needs CAP_NET_ADMIN and the ip command, e.g.:
+//
+//	bench -queues 4 -senders 8 -stack
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zinoulink/tun2ray/tun"
+
+	"github.com/eycorsican/go-tun2socks/core"
+)
+
+const mtu = 1500
+
+// discardHandler drops the UDP packets reaching the stack.
+type discardHandler struct{}
+
+func (discardHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return nil
+}
+
+func (discardHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
+	return nil
+}
+
+func ip(args string) error {
+	out, err := exec.Command("ip", strings.Split(args, " ")...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v: %s", args, err, out)
+	}
+	return nil
+}
+
+func main() {
+	name := flag.String("name", "tunbench", "TUN interface name")
+	queues := flag.Int("queues", 1, "Number of queues, each read by its own goroutine")
+	senders := flag.Int("senders", 4, "Number of sending sockets, each a flow of its own")
+	size := flag.Int("size", 64, "UDP payload size")
+	duration := flag.Duration("duration", 10*time.Second, "How long packets are sent")
+	stack := flag.Bool("stack", false, "Write the packets read to the lwIP stack")
+	flag.Parse()
+
+	tunQueues, err := tun.OpenTunDeviceQueues(*name, "", "", "", nil, false, *queues)
+	if err != nil {
+		log.Fatalf("failed to open tun device: %v", err)
+	}
+	defer tunQueues.Close()
+	for _, args := range []string{
+		"addr add 10.255.254.1/24 dev " + *name,
+		"link set " + *name + " up",
+	} {
+		if err := ip(args); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var w io.Writer = ioutil.Discard
+	if *stack {
+		core.RegisterUDPConnHandler(discardHandler{})
+		core.RegisterOutputFn(tunQueues.Write)
+		lwipStack := core.NewLWIPStack()
+		defer lwipStack.Close()
+		w = lwipStack
+	}
+
+	counts := make([]uint64, len(tunQueues))
+	var readers sync.WaitGroup
+	for i, queue := range tunQueues {
+		readers.Add(1)
+		go func(queue io.Reader, count *uint64) {
+			defer readers.Done()
+			buf := make([]byte, mtu)
+			for {
+				n, err := queue.Read(buf)
+				if err != nil {
+					return
+				}
+				w.Write(buf[:n])
+				atomic.AddUint64(count, 1)
+			}
+		}(queue, &counts[i])
+	}
+
+	done := make(chan struct{})
+	var sent uint64
+	var senderGroup sync.WaitGroup
+	for i := 0; i < *senders; i++ {
+		conn, err := net.Dial("udp", fmt.Sprintf("10.255.254.2:%d", 10000+i))
+		if err != nil {
+			log.Fatal(err)
+		}
+		senderGroup.Add(1)
+		go func(conn net.Conn) {
+			defer senderGroup.Done()
+			defer conn.Close()
+			payload := make([]byte, *size)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := conn.Write(payload); err == nil {
+					atomic.AddUint64(&sent, 1)
+				}
+			}
+		}(conn)
+	}
+
+	start := time.Now()
+	time.Sleep(*duration)
+	close(done)
+	senderGroup.Wait()
+	elapsed := time.Since(start)
+	tunQueues.Close()
+	readers.Wait()
+
+	var total uint64
+	for i := range counts {
+		total += counts[i]
+		fmt.Printf("queue %d: %d packets\n", i, counts[i])
+	}
+	fmt.Printf("sent %d packets, read %d packets, %.0f packets/s\n", sent, total, float64(total)/elapsed.Seconds())
+}
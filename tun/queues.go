@@ -0,0 +1,52 @@
+package tun
+
+import (
+	"io"
+	"sync"
+)
+
+// Queues are the queues of a TUN device, each read by its own goroutine.
+// The kernel spreads flows over the queues of a multi-queue device.
+type Queues []io.ReadWriteCloser
+
+// queue serializes the writes to a queue of the device. lwIP doesn't: UDP
+// replies are written to the stack without its lock, so the output
+// function runs from several goroutines at once.
+type queue struct {
+	io.ReadWriteCloser
+
+	mu sync.Mutex
+}
+
+func (q *queue) Write(b []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.ReadWriteCloser.Write(b)
+}
+
+// newQueues returns the queues of devs, each safe for concurrent writes.
+func newQueues(devs ...io.ReadWriteCloser) Queues {
+	queues := make(Queues, len(devs))
+	for i, dev := range devs {
+		queues[i] = &queue{ReadWriteCloser: dev}
+	}
+	return queues
+}
+
+// Write writes a packet to the first queue, as a TUN device takes packets
+// of any flow on any queue and a flow keeps its order on a single queue.
+// It is safe for concurrent use.
+func (q Queues) Write(b []byte) (int, error) {
+	return q[0].Write(b)
+}
+
+// Close closes all the queues, returning the first error.
+func (q Queues) Close() error {
+	var err error
+	for _, dev := range q {
+		if e := dev.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
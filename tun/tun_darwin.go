@@ -65,3 +65,13 @@ func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist boo
 	}
 	return tunDev, nil
 }
+
+// OpenTunDeviceQueues opens the TUN device with a single queue, multiple
+// queues are only supported on Linux.
+func OpenTunDeviceQueues(name, addr, gw, mask string, dnsServers []string, persist bool, n int) (Queues, error) {
+	tunDev, err := OpenTunDevice(name, addr, gw, mask, dnsServers, persist)
+	if err != nil {
+		return nil, err
+	}
+	return newQueues(tunDev), nil
+}
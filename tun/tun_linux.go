@@ -19,3 +19,34 @@ func OpenTunDevice(name, addr, gw, mask string, dnsServers []string, persist boo
 	name = tunDev.Name()
 	return tunDev, nil
 }
+
+// OpenTunDeviceQueues opens the TUN device with n queues. With more than
+// one, the device is created with IFF_MULTI_QUEUE, which needs Linux 3.8,
+// and each queue is a file of its own.
+func OpenTunDeviceQueues(name, addr, gw, mask string, dnsServers []string, persist bool, n int) (Queues, error) {
+	if n <= 1 {
+		tunDev, err := OpenTunDevice(name, addr, gw, mask, dnsServers, persist)
+		if err != nil {
+			return nil, err
+		}
+		return newQueues(tunDev), nil
+	}
+	devs := make([]io.ReadWriteCloser, 0, n)
+	for i := 0; i < n; i++ {
+		cfg := water.Config{
+			DeviceType: water.TUN,
+		}
+		cfg.Name = name
+		cfg.Persist = persist
+		cfg.MultiQueue = true
+		tunDev, err := water.New(cfg)
+		if err != nil {
+			Queues(devs).Close()
+			return nil, err
+		}
+		// The next queues attach to the device created by the first one.
+		name = tunDev.Name()
+		devs = append(devs, tunDev)
+	}
+	return newQueues(devs...), nil
+}
@@ -391,3 +391,13 @@ func (dev *winTapDev) Close() error {
 	sendStopMarker(dev.addr, dev.gw)
 	return windows.Close(dev.fd)
 }
+
+// OpenTunDeviceQueues opens the TUN device with a single queue, multiple
+// queues are only supported on Linux.
+func OpenTunDeviceQueues(name, addr, gw, mask string, dnsServers []string, persist bool, n int) (Queues, error) {
+	tunDev, err := OpenTunDevice(name, addr, gw, mask, dnsServers, persist)
+	if err != nil {
+		return nil, err
+	}
+	return newQueues(tunDev), nil
+}
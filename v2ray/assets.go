@@ -0,0 +1,47 @@
+package v2ray
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/v2fly/v2ray-core/v4/common/platform/filesystem"
+)
+
+var assetsMu sync.RWMutex
+var assets = make(map[string][]byte)
+var installReader sync.Once
+
+// SetAssetDir sets the directory V2Ray loads assets from, such as geoip.dat
+// and geosite.dat.
+func SetAssetDir(dir string) {
+	os.Setenv("v2ray.location.asset", dir)
+}
+
+// SetAsset makes V2Ray read the asset file name, e.g. "geoip.dat", from data
+// instead of from the asset directory. A nil data removes it.
+func SetAsset(name string, data []byte) {
+	installReader.Do(func() {
+		openFile := filesystem.NewFileReader
+		filesystem.NewFileReader = func(path string) (io.ReadCloser, error) {
+			assetsMu.RLock()
+			data, ok := assets[filepath.Base(path)]
+			assetsMu.RUnlock()
+			if ok {
+				return ioutil.NopCloser(bytes.NewReader(data)), nil
+			}
+			return openFile(path)
+		}
+	})
+
+	assetsMu.Lock()
+	defer assetsMu.Unlock()
+	if data == nil {
+		delete(assets, name)
+	} else {
+		assets[name] = data
+	}
+}
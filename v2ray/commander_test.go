@@ -0,0 +1,67 @@
+package v2ray
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	vcore "github.com/v2fly/v2ray-core/v4"
+	statscmd "github.com/v2fly/v2ray-core/v4/app/stats/command"
+	"google.golang.org/grpc"
+)
+
+// commanderConfig serves StatsService on a dokodemo-door inbound tagged
+// api, which counts its own traffic.
+const commanderConfig = `{
+	"stats": {},
+	"api": {"tag": "api", "services": ["StatsService"]},
+	"policy": {"system": {"statsInboundUplink": true, "statsInboundDownlink": true}},
+	"inbounds": [{
+		"tag": "api",
+		"listen": "127.0.0.1",
+		"port": %d,
+		"protocol": "dokodemo-door",
+		"settings": {"address": "127.0.0.1"}
+	}],
+	"outbounds": [{"protocol": "freedom"}],
+	"routing": {"rules": [{"type": "field", "inboundTag": ["api"], "outboundTag": "api"}]}
+}`
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestCommanderStats(t *testing.T) {
+	port := freePort(t)
+	v, err := vcore.StartInstance("json", []byte(fmt.Sprintf(commanderConfig, port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, fmt.Sprintf("127.0.0.1:%d", port), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The request itself went through the api inbound.
+	resp, err := statscmd.NewStatsServiceClient(conn).GetStats(ctx, &statscmd.GetStatsRequest{
+		Name: "inbound>>>api>>>traffic>>>uplink",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Stat.Value <= 0 {
+		t.Fatalf("%s = %d", resp.Stat.Name, resp.Stat.Value)
+	}
+}
@@ -0,0 +1,35 @@
+package v2ray
+
+import (
+	"context"
+
+	vcore "github.com/v2fly/v2ray-core/v4"
+	vnet "github.com/v2fly/v2ray-core/v4/common/net"
+	vdns "github.com/v2fly/v2ray-core/v4/features/dns"
+)
+
+// contextWithInstance returns ctx carrying v. Features V2Ray creates per
+// connection, such as the fake DNS sniffer of the dispatcher, look up the
+// instance in the context and panic without it.
+func contextWithInstance(ctx context.Context, v *vcore.Instance) context.Context {
+	return context.WithValue(ctx, vcore.V2rayKey(1), v)
+}
+
+// noFakeDNS stands in for the fake DNS of V2Ray when its config has none.
+// The dispatcher asks for one each time it sniffs a connection, and the
+// instance queues the request, unlocked and forever, until a fake DNS is
+// registered.
+type noFakeDNS struct{}
+
+func (noFakeDNS) Type() interface{}                               { return (*vdns.FakeDNSEngine)(nil) }
+func (noFakeDNS) Start() error                                    { return nil }
+func (noFakeDNS) Close() error                                    { return nil }
+func (noFakeDNS) GetFakeIPForDomain(domain string) []vnet.Address { return nil }
+func (noFakeDNS) GetDomainFromFakeDNS(ip vnet.Address) string     { return "" }
+
+// requireFakeDNS registers noFakeDNS in v if it has no fake DNS.
+func requireFakeDNS(v *vcore.Instance) {
+	if v.GetFeature((*vdns.FakeDNSEngine)(nil)) == nil {
+		v.AddFeature(noFakeDNS{})
+	}
+}
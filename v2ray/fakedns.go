@@ -0,0 +1,25 @@
+package v2ray
+
+import (
+	"net"
+
+	vnet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+// FakeDNS maps fake IPs handed out by a fake DNS server back to domains.
+type FakeDNS interface {
+	DomainForIP(ip net.IP) (string, bool)
+}
+
+// destination converts addr to a V2Ray destination, replacing fake IPs by
+// their domain so that V2Ray resolves them remotely.
+func destination(fakeDNS FakeDNS, addr net.Addr) vnet.Destination {
+	dest := vnet.DestinationFromAddr(addr)
+	if fakeDNS == nil || !dest.Address.Family().IsIP() {
+		return dest
+	}
+	if domain, ok := fakeDNS.DomainForIP(dest.Address.IP()); ok {
+		dest.Address = vnet.DomainAddress(domain)
+	}
+	return dest
+}
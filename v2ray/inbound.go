@@ -0,0 +1,37 @@
+package v2ray
+
+import (
+	"context"
+	"net"
+
+	vnet "github.com/v2fly/v2ray-core/v4/common/net"
+	vsession "github.com/v2fly/v2ray-core/v4/common/session"
+)
+
+// contextWithInbound returns the context of a connection from src. The
+// inbound of ctx, which holds the inbound tag, is copied with src as source,
+// so that V2Ray routing rules match on inboundTag, source and sourcePort.
+func contextWithInbound(ctx context.Context, src net.Addr) context.Context {
+	inbound := new(vsession.Inbound)
+	if base := vsession.InboundFromContext(ctx); base != nil {
+		*inbound = *base
+	}
+	inbound.Source = vnet.DestinationFromAddr(src)
+	return vsession.ContextWithInbound(ctx, inbound)
+}
+
+// contextWithContent returns the context of a connection with its own copy
+// of the content of ctx. V2Ray writes the sniffed protocol and the forced
+// outbound tag into the content, which would otherwise be shared by every
+// connection of the handler.
+func contextWithContent(ctx context.Context) context.Context {
+	content := new(vsession.Content)
+	if base := vsession.ContentFromContext(ctx); base != nil {
+		*content = *base
+		content.Attributes = nil
+		for name, value := range base.Attributes {
+			content.SetAttribute(name, value)
+		}
+	}
+	return vsession.ContextWithContent(ctx, content)
+}
@@ -2,56 +2,98 @@ package v2ray
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"time"
 
-	vcore "v2ray.com/core"
-	vnet "v2ray.com/core/common/net"
-	vsession "v2ray.com/core/common/session"
+	vcore "github.com/v2fly/v2ray-core/v4"
+	vcommon "github.com/v2fly/v2ray-core/v4/common"
+	vnet "github.com/v2fly/v2ray-core/v4/common/net"
+	vsession "github.com/v2fly/v2ray-core/v4/common/session"
+	vrouting "github.com/v2fly/v2ray-core/v4/features/routing"
+	vtransport "github.com/v2fly/v2ray-core/v4/transport"
+
+	"github.com/zinoulink/tun2ray/relay"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 )
 
 type tcpHandler struct {
-	ctx context.Context
-	v   *vcore.Instance
+	ctx     context.Context
+	v       *vcore.Instance
+	fakeDNS FakeDNS
+	// halfOpenTimeout is how long connections closed by one side are
+	// kept open without data.
+	halfOpenTimeout time.Duration
+}
+
+// linkConn is a connection on top of a V2Ray link. Unlike the one returned
+// by vcore.Dial, its write side can be closed alone, which V2Ray sees as
+// the end of the uplink.
+type linkConn struct {
+	net.Conn
+	link *vtransport.Link
 }
 
-func (h *tcpHandler) handleInput(conn net.Conn, input io.ReadCloser) {
-	defer func() {
-		conn.Close()
-		input.Close()
-	}()
-	io.Copy(conn, input)
+func dialTCP(ctx context.Context, v *vcore.Instance, dest vnet.Destination) (*linkConn, error) {
+	dispatcher := v.GetFeature(vrouting.DispatcherType())
+	if dispatcher == nil {
+		return nil, errors.New("routing.Dispatcher is not registered in V2Ray core")
+	}
+	link, err := dispatcher.(vrouting.Dispatcher).Dispatch(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	return &linkConn{
+		Conn: vnet.NewConnection(vnet.ConnectionInputMulti(link.Writer), vnet.ConnectionOutputMulti(link.Reader)),
+		link: link,
+	}, nil
 }
 
-func (h *tcpHandler) handleOutput(conn net.Conn, output io.WriteCloser) {
-	defer func() {
-		conn.Close()
-		output.Close()
-	}()
-	io.Copy(output, conn)
+func (c *linkConn) CloseWrite() error {
+	return vcommon.Close(c.link.Writer)
 }
 
-func NewTCPHandler(ctx context.Context, instance *vcore.Instance) core.TCPConnHandler {
+// Close aborts the uplink if it is still open, so that V2Ray doesn't take
+// it for a clean end.
+func (c *linkConn) Close() error {
+	vcommon.Interrupt(c.link.Writer)
+	return c.Conn.Close()
+}
+
+func NewTCPHandler(ctx context.Context, instance *vcore.Instance, fakeDNS FakeDNS, halfOpenTimeout time.Duration) core.TCPConnHandler {
+	requireFakeDNS(instance)
 	return &tcpHandler{
-		ctx: ctx,
-		v:   instance,
+		ctx:             ctx,
+		v:               instance,
+		fakeDNS:         fakeDNS,
+		halfOpenTimeout: halfOpenTimeout,
 	}
 }
 
 func (h *tcpHandler) Handle(conn net.Conn, target *net.TCPAddr) error {
-	dest := vnet.DestinationFromAddr(target)
+	return h.HandleWithTag(conn, target, "")
+}
+
+// HandleWithTag sends the connection through the outbound tagged tag,
+// bypassing V2Ray routing. An empty tag lets V2Ray route the connection.
+func (h *tcpHandler) HandleWithTag(conn net.Conn, target *net.TCPAddr, tag string) error {
+	dest := destination(h.fakeDNS, target)
 	sid := vsession.NewID()
-	ctx := vsession.ContextWithID(h.ctx, sid)
-	c, err := vcore.Dial(ctx, h.v, dest)
+	ctx := vsession.ContextWithID(contextWithInstance(h.ctx, h.v), sid)
+	ctx = contextWithInbound(ctx, conn.LocalAddr())
+	ctx = contextWithContent(ctx)
+	if tag != "" {
+		ctx = vsession.SetForcedOutboundTagToContext(ctx, tag)
+	}
+	c, err := dialTCP(ctx, h.v, dest)
 	if err != nil {
 		return fmt.Errorf("dial V proxy connection failed: %v", err)
 	}
-	go h.handleInput(conn, c)
-	go h.handleOutput(conn, c)
-	log.Infof("new proxy connection for target: %s:%s", target.Network(), target.String())
+	track(conn, dest, tag)
+	go relay.TCP(conn, c, h.halfOpenTimeout)
+	log.Infof("new proxy connection for target: %s:%s", target.Network(), dest.NetAddr())
 	return nil
 }
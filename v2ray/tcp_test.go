@@ -0,0 +1,112 @@
+package v2ray
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	vcore "github.com/v2fly/v2ray-core/v4"
+	vsession "github.com/v2fly/v2ray-core/v4/common/session"
+)
+
+// taggedConfig sends connections to the blackhole unless they are tagged
+// direct.
+const taggedConfig = `{
+	"outbounds": [
+		{"tag": "block", "protocol": "blackhole"},
+		{"tag": "direct", "protocol": "freedom"}
+	]
+}`
+
+// echoServer returns the address of a server echoing what it reads.
+func echoServer(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// appConn returns the app end of a connection and the end given to the
+// handler.
+func appConn(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	app, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		app.Close()
+		conn.Close()
+	})
+	return app, conn
+}
+
+// Flows tagged concurrently each go through their own outbound, and the
+// tag does not leak into the shared context of the handler. Run with -race.
+func TestHandleWithTagConcurrent(t *testing.T) {
+	v, err := vcore.StartInstance("json", []byte(taggedConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	server := echoServer(t)
+
+	// The engine shares a content with the sniffing settings.
+	base := &vsession.Content{SniffingRequest: vsession.SniffingRequest{Enabled: true, OverrideDestinationForProtocol: []string{"http", "tls"}}}
+	h := NewTCPHandler(vsession.ContextWithContent(context.Background(), base), v, nil, time.Minute).(*tcpHandler)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		for _, tag := range []string{"direct", "block"} {
+			wg.Add(1)
+			go func(tag string) {
+				defer wg.Done()
+				app, conn := appConn(t)
+				if err := h.HandleWithTag(conn, server, tag); err != nil {
+					t.Error(err)
+					return
+				}
+				app.SetDeadline(time.Now().Add(2 * time.Second))
+				app.Write([]byte("ping"))
+				buf := make([]byte, 4)
+				_, err := io.ReadFull(app, buf)
+				if tag == "direct" && err != nil {
+					t.Errorf("direct flow: %v", err)
+				}
+				if tag == "block" && err == nil {
+					t.Errorf("blocked flow got %q", buf)
+				}
+			}(tag)
+		}
+	}
+	wg.Wait()
+
+	if len(base.Attributes) != 0 {
+		t.Fatalf("shared content has attributes %v", base.Attributes)
+	}
+}
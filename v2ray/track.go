@@ -0,0 +1,42 @@
+package v2ray
+
+import (
+	"time"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+
+	vnet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+// track records the route and the domain of dest in the flow of conn, if
+// the connection is tracked. The route is kept if already set by a handler
+// in front of this one.
+func track(conn interface{}, dest vnet.Destination, tag string) {
+	f := conntrack.FlowOf(conn)
+	if f == nil {
+		return
+	}
+	if f.Route() == "" {
+		if tag == "" {
+			tag = "proxy"
+		}
+		f.SetRoute(tag)
+	}
+	if dest.Address.Family().IsDomain() {
+		f.SetDomain(dest.Address.Domain())
+	}
+}
+
+// setCloseReason sets the close reason of the flow of conn, if tracked.
+func setCloseReason(conn interface{}, reason string) {
+	if f := conntrack.FlowOf(conn); f != nil {
+		f.SetCloseReason(reason)
+	}
+}
+
+// setIdleTimeout sets the idle timeout of the flow of conn, if tracked.
+func setIdleTimeout(conn interface{}, timeout time.Duration) {
+	if f := conntrack.FlowOf(conn); f != nil {
+		f.SetIdleTimeout(timeout)
+	}
+}
@@ -8,41 +8,83 @@ import (
 	"sync"
 	"time"
 
-	vcore "v2ray.com/core"
-	vsession "v2ray.com/core/common/session"
-	vsignal "v2ray.com/core/common/signal"
-	vtask "v2ray.com/core/common/task"
+	vcore "github.com/v2fly/v2ray-core/v4"
+	vnet "github.com/v2fly/v2ray-core/v4/common/net"
+	vsession "github.com/v2fly/v2ray-core/v4/common/session"
+	vsignal "github.com/v2fly/v2ray-core/v4/common/signal"
+	vtask "github.com/v2fly/v2ray-core/v4/common/task"
+	vpolicy "github.com/v2fly/v2ray-core/v4/features/policy"
+
+	"github.com/zinoulink/tun2ray/conntrack"
 
 	"github.com/eycorsican/go-tun2socks/common/log"
 	"github.com/eycorsican/go-tun2socks/core"
 )
 
+// udpConnEntry is a UDP session sent to V2Ray. The session can send to
+// many remote addresses, and replies are written back with the address
+// they come from. V2Ray packets carry no address, so the dispatcher keeps
+// a link per remote address and outbounds connect their socket to it: the
+// NAT is port-restricted cone, only the addresses and ports the app sent
+// to can reply. Full cone would need packet-addressed links, which V2Ray
+// 4.36 lacks.
 type udpConnEntry struct {
-	conn net.PacketConn
+	sync.Mutex
 
-	// `ReadFrom` method of PacketConn given by V2Ray
-	// won't return the correct remote address, we treat
-	// all data receive from V2Ray are coming from the
-	// same remote host, i.e. the `target` that passed
-	// to `Connect`.
-	target *net.UDPAddr
+	conn *dispatcherConn
+
+	// addrs maps the domain destinations of fake IPs to the fake
+	// addresses the app sent to.
+	addrs map[vnet.Destination]*net.UDPAddr
 
 	updater vsignal.ActivityUpdater
 }
 
+// source returns the address replies from dest come from for the app.
+func (c *udpConnEntry) source(dest vnet.Destination) (*net.UDPAddr, bool) {
+	if dest.Address.Family().IsIP() {
+		return &net.UDPAddr{IP: dest.Address.IP(), Port: int(dest.Port)}, true
+	}
+	c.Lock()
+	defer c.Unlock()
+	addr, ok := c.addrs[dest]
+	return addr, ok
+}
+
+// destination returns the V2Ray destination of addr, remembering the fake
+// address of domain destinations.
+func (c *udpConnEntry) destination(fakeDNS FakeDNS, addr *net.UDPAddr) vnet.Destination {
+	dest := destination(fakeDNS, addr)
+	if !dest.Address.Family().IsIP() {
+		c.Lock()
+		if _, ok := c.addrs[dest]; !ok {
+			c.addrs[dest] = addr
+		}
+		c.Unlock()
+	}
+	return dest
+}
+
 type udpHandler struct {
-	sync.Mutex
+	ctx      context.Context
+	v        *vcore.Instance
+	fakeDNS  FakeDNS
+	conns    *conntrack.UDPTable
+	timeouts *conntrack.UDPTimeouts
+	// policyTimeout overrides the timeouts if not zero.
+	policyTimeout time.Duration
+}
 
-	ctx     context.Context
-	v       *vcore.Instance
-	conns   map[core.UDPConn]*udpConnEntry
-	timeout time.Duration // Maybe override by V2Ray local policies for some conns.
+func (h *udpHandler) entry(conn core.UDPConn) (*udpConnEntry, bool) {
+	c, ok := h.conns.Load(conn)
+	if !ok {
+		return nil, false
+	}
+	return c.(*udpConnEntry), true
 }
 
 func (h *udpHandler) fetchInput(conn core.UDPConn) {
-	h.Lock()
-	c, ok := h.conns[conn]
-	h.Unlock()
+	c, ok := h.entry(conn)
 	if !ok {
 		return
 	}
@@ -51,14 +93,19 @@ func (h *udpHandler) fetchInput(conn core.UDPConn) {
 	defer core.FreeBytes(buf)
 
 	for {
-		n, _, err := c.conn.ReadFrom(buf)
+		n, dest, err := c.conn.ReadFromDestination(buf)
 		if err != nil && n <= 0 {
 			h.Close(conn)
 			conn.Close()
 			return
 		}
 		c.updater.Update()
-		_, err = conn.WriteFrom(buf[:n], c.target)
+		addr, ok := c.source(dest)
+		if !ok {
+			log.Debugf("dropped udp reply from unknown %s", dest)
+			continue
+		}
+		_, err = conn.WriteFrom(buf[:n], addr)
 		if err != nil {
 			h.Close(conn)
 			conn.Close()
@@ -67,40 +114,73 @@ func (h *udpHandler) fetchInput(conn core.UDPConn) {
 	}
 }
 
-func NewUDPHandler(ctx context.Context, instance *vcore.Instance, timeout time.Duration) core.UDPConnHandler {
-	return &udpHandler{
-		ctx:     ctx,
-		v:       instance,
-		conns:   make(map[core.UDPConn]*udpConnEntry, 16),
-		timeout: timeout,
+// NewUDPHandler returns a handler sending UDP sessions to V2Ray, idle for
+// at most their timeout in timeouts. If policyLevel is not negative, the
+// connIdle timeout of this V2Ray policy level is used instead.
+func NewUDPHandler(ctx context.Context, instance *vcore.Instance, fakeDNS FakeDNS, timeouts *conntrack.UDPTimeouts, policyLevel int) core.UDPConnHandler {
+	requireFakeDNS(instance)
+	h := &udpHandler{
+		ctx:      ctx,
+		v:        instance,
+		fakeDNS:  fakeDNS,
+		conns:    conntrack.NewUDPTable(),
+		timeouts: timeouts,
+	}
+	if policyLevel >= 0 {
+		if pm, ok := instance.GetFeature(vpolicy.ManagerType()).(vpolicy.Manager); ok {
+			h.policyTimeout = pm.ForLevel(uint32(policyLevel)).Timeouts.ConnectionIdle
+		}
+	}
+	return h
+}
+
+// timeout returns the idle timeout of a session to target.
+func (h *udpHandler) timeout(target *net.UDPAddr) time.Duration {
+	if h.policyTimeout > 0 {
+		return h.policyTimeout
 	}
+	return h.timeouts.Timeout(target.Port)
 }
 
 func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
+	return h.ConnectWithTag(conn, target, "")
+}
+
+// ConnectWithTag sends the connection through the outbound tagged tag,
+// bypassing V2Ray routing. An empty tag lets V2Ray route the connection.
+func (h *udpHandler) ConnectWithTag(conn core.UDPConn, target *net.UDPAddr, tag string) error {
 	if target == nil {
 		return errors.New("nil target is not allowed")
 	}
 	sid := vsession.NewID()
-	ctx := vsession.ContextWithID(h.ctx, sid)
+	ctx := vsession.ContextWithID(contextWithInstance(h.ctx, h.v), sid)
+	ctx = contextWithInbound(ctx, conn.LocalAddr())
+	ctx = contextWithContent(ctx)
+	if tag != "" {
+		ctx = vsession.SetForcedOutboundTagToContext(ctx, tag)
+	}
 	ctx, cancel := context.WithCancel(ctx)
-	pc, err := vcore.DialUDP(ctx, h.v)
+	pc, err := dialUDP(ctx, h.v)
 	if err != nil {
+		cancel()
 		return fmt.Errorf("dial V proxy connection failed: %v", err)
 	}
-	timer := vsignal.CancelAfterInactivity(ctx, cancel, h.timeout)
-	h.Lock()
-	h.conns[conn] = &udpConnEntry{
+	track(conn, destination(h.fakeDNS, target), tag)
+	timeout := h.timeout(target)
+	setIdleTimeout(conn, timeout)
+	timer := vsignal.CancelAfterInactivity(ctx, cancel, timeout)
+	h.conns.Store(conn, &udpConnEntry{
 		conn:    pc,
-		target:  target,
+		addrs:   make(map[vnet.Destination]*net.UDPAddr),
 		updater: timer,
-	}
-	h.Unlock()
+	})
 	fetchTask := func() error {
 		h.fetchInput(conn)
 		return nil
 	}
 	go func() {
 		if err := vtask.Run(ctx, fetchTask); err != nil {
+			setCloseReason(conn, "idle timeout")
 			pc.Close()
 		}
 	}()
@@ -109,12 +189,8 @@ func (h *udpHandler) Connect(conn core.UDPConn, target *net.UDPAddr) error {
 }
 
 func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr) error {
-	h.Lock()
-	c, ok := h.conns[conn]
-	h.Unlock()
-
-	if ok {
-		_, err := c.conn.WriteTo(data, addr)
+	if c, ok := h.entry(conn); ok {
+		_, err := c.conn.WriteToDestination(data, c.destination(h.fakeDNS, addr))
 		c.updater.Update()
 		if err != nil {
 			h.Close(conn)
@@ -123,16 +199,12 @@ func (h *udpHandler) ReceiveTo(conn core.UDPConn, data []byte, addr *net.UDPAddr
 		return nil
 	} else {
 		h.Close(conn)
-		return fmt.Errorf("proxy connection %v->%v does not exists", conn.LocalAddr(), c.target)
+		return fmt.Errorf("proxy connection %v->%v does not exists", conn.LocalAddr(), addr)
 	}
 }
 
 func (h *udpHandler) Close(conn core.UDPConn) {
-	h.Lock()
-	defer h.Unlock()
-
-	if c, found := h.conns[conn]; found {
-		c.conn.Close()
+	if c, found := h.conns.LoadAndDelete(conn); found {
+		c.(*udpConnEntry).conn.Close()
 	}
-	delete(h.conns, conn)
 }
@@ -0,0 +1,102 @@
+package v2ray
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	vcore "github.com/v2fly/v2ray-core/v4"
+
+	"github.com/zinoulink/tun2ray/conntrack"
+)
+
+// reply is a packet written back to the app.
+type reply struct {
+	data string
+	addr string
+}
+
+// appUDPConn is a UDP session from the core, passing what is written back
+// to replies.
+type appUDPConn struct {
+	replies chan reply
+}
+
+func (c *appUDPConn) LocalAddr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5000}
+}
+
+func (c *appUDPConn) ReceiveTo(data []byte, addr *net.UDPAddr) error { return nil }
+
+func (c *appUDPConn) WriteFrom(data []byte, addr *net.UDPAddr) (int, error) {
+	c.replies <- reply{string(data), addr.String()}
+	return len(data), nil
+}
+
+func (c *appUDPConn) Close() error { return nil }
+
+// fakeDomains maps fake IPs to domains.
+type fakeDomains map[string]string
+
+func (f fakeDomains) DomainForIP(ip net.IP) (string, bool) {
+	domain, ok := f[ip.String()]
+	return domain, ok
+}
+
+// udpEcho returns the address of a server echoing the packets it reads.
+func udpEcho(t *testing.T) *net.UDPAddr {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(append([]byte("echo "), buf[:n]...), addr)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr)
+}
+
+// A session sending to several peers gets the replies of each with its
+// address, the fake one for domains.
+func TestUDPRepliesFromPeers(t *testing.T) {
+	v, err := vcore.StartInstance("json", []byte(`{"outbounds": [{"protocol": "freedom"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	first, second, named := udpEcho(t), udpEcho(t), udpEcho(t)
+	fake := &net.UDPAddr{IP: net.IPv4(198, 18, 0, 1), Port: named.Port}
+	h := NewUDPHandler(context.Background(), v, fakeDomains{"198.18.0.1": "localhost"}, &conntrack.UDPTimeouts{Default: time.Minute}, -1)
+
+	conn := &appUDPConn{replies: make(chan reply, 3)}
+	if err := h.Connect(conn, first); err != nil {
+		t.Fatal(err)
+	}
+	defer h.(*udpHandler).Close(conn)
+	want := map[string]string{}
+	for i, addr := range []*net.UDPAddr{first, second, fake} {
+		msg := string(rune('a' + i))
+		if err := h.ReceiveTo(conn, []byte(msg), addr); err != nil {
+			t.Fatal(err)
+		}
+		want["echo "+msg] = addr.String()
+	}
+	for range want {
+		select {
+		case r := <-conn.replies:
+			if want[r.data] != r.addr {
+				t.Errorf("%q from %s, want %s", r.data, r.addr, want[r.data])
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("reply not written back")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package v2ray
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	vcore "github.com/v2fly/v2ray-core/v4"
+	vbuf "github.com/v2fly/v2ray-core/v4/common/buf"
+	vnet "github.com/v2fly/v2ray-core/v4/common/net"
+	vudpproto "github.com/v2fly/v2ray-core/v4/common/protocol/udp"
+	vdone "github.com/v2fly/v2ray-core/v4/common/signal/done"
+	vrouting "github.com/v2fly/v2ray-core/v4/features/routing"
+	vudp "github.com/v2fly/v2ray-core/v4/transport/internet/udp"
+)
+
+// dispatcherConn is a PacketConn on top of the V2Ray UDP dispatcher. Unlike
+// the one returned by vcore.DialUDP, which dispatches packets with an empty
+// context, it dispatches packets with the session context it was created
+// with, so that routing sees the session metadata of the connection.
+type dispatcherConn struct {
+	ctx        context.Context
+	dispatcher *vudp.Dispatcher
+	cache      chan *vudpproto.Packet
+	done       *vdone.Instance
+}
+
+func dialUDP(ctx context.Context, v *vcore.Instance) (*dispatcherConn, error) {
+	dispatcher := v.GetFeature(vrouting.DispatcherType())
+	if dispatcher == nil {
+		return nil, errors.New("routing.Dispatcher is not registered in V2Ray core")
+	}
+	c := &dispatcherConn{
+		ctx:   ctx,
+		cache: make(chan *vudpproto.Packet, 16),
+		done:  vdone.New(),
+	}
+	c.dispatcher = vudp.NewDispatcher(dispatcher.(vrouting.Dispatcher), c.callback)
+	return c, nil
+}
+
+func (c *dispatcherConn) callback(ctx context.Context, packet *vudpproto.Packet) {
+	select {
+	case <-c.done.Wait():
+		packet.Payload.Release()
+	case c.cache <- packet:
+	default:
+		packet.Payload.Release()
+	}
+}
+
+func (c *dispatcherConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, source, err := c.ReadFromDestination(p)
+	if err != nil || !source.Address.Family().IsIP() {
+		// Replies from a domain destination, the caller knows
+		// which address it stands for.
+		return n, nil, err
+	}
+	return n, &net.UDPAddr{
+		IP:   source.Address.IP(),
+		Port: int(source.Port),
+	}, nil
+}
+
+// ReadFromDestination is like ReadFrom, but returns the V2Ray destination
+// the packet is a reply from, which can be a domain. The dispatcher keeps a
+// link per destination, so that replies are told apart by destination.
+func (c *dispatcherConn) ReadFromDestination(p []byte) (int, vnet.Destination, error) {
+	select {
+	case <-c.done.Wait():
+		return 0, vnet.Destination{}, io.EOF
+	case packet := <-c.cache:
+		n := copy(p, packet.Payload.Bytes())
+		packet.Payload.Release()
+		return n, packet.Source, nil
+	}
+}
+
+func (c *dispatcherConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.WriteToDestination(p, vnet.DestinationFromAddr(addr))
+}
+
+// WriteToDestination is like WriteTo, but takes a V2Ray destination which
+// can be a domain.
+func (c *dispatcherConn) WriteToDestination(p []byte, dest vnet.Destination) (int, error) {
+	buffer := vbuf.New()
+	raw := buffer.Extend(vbuf.Size)
+	n := copy(raw, p)
+	buffer.Resize(0, int32(n))
+
+	c.dispatcher.Dispatch(c.ctx, dest, buffer)
+	return n, nil
+}
+
+func (c *dispatcherConn) Close() error {
+	return c.done.Close()
+}
+
+func (c *dispatcherConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{
+		IP:   []byte{0, 0, 0, 0},
+		Port: 0,
+	}
+}
+
+func (c *dispatcherConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dispatcherConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dispatcherConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
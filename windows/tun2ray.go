@@ -5,22 +5,14 @@ package main
 
 import "C"
 import (
-	"context"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/zinoulink/tun2ray/d"
+	"github.com/zinoulink/tun2ray/engine"
 	"github.com/zinoulink/tun2ray/tun"
-	"github.com/zinoulink/tun2ray/v2ray"
-
-	vcore "v2ray.com/core"
-	vproxyman "v2ray.com/core/app/proxyman"
-	vbytespool "v2ray.com/core/common/bytespool"
-	"v2ray.com/core/common/session"
 
 	"github.com/eycorsican/go-tun2socks/core"
 )
@@ -28,14 +20,17 @@ import (
 func main() {}
 
 var lwipStack core.LWIPStack
-var v *vcore.Instance
+var e *engine.Engine
 var isStopped = false
 var tunDev io.ReadWriteCloser
 var err error
 
+// StartTun2Ray opens the TUN device and starts tun2ray. options is a JSON object of
+// engine.Options, unknown fields are ignored and missing ones take their default value.
+//
 //export StartTun2Ray
 func StartTun2Ray(tunName *C.char, tunAddr *C.char, tunGw *C.char, tunMask *C.char, tunDNS *C.char,
-	config *C.char, exceptionApps *C.char, sendThrough *C.char, MTU int) *C.char {
+	config *C.char, options *C.char) *C.char {
 
 	// Coverte parameters to Go string
 	TunName := C.GoString(tunName)
@@ -44,10 +39,11 @@ func StartTun2Ray(tunName *C.char, tunAddr *C.char, tunGw *C.char, tunMask *C.ch
 	TunMask := C.GoString(tunMask)
 	TunDNS := C.GoString(tunDNS)
 	Config := C.GoString(config)
-	ExceptionApps := C.GoString(exceptionApps)
-	SendThrough := C.GoString(sendThrough)
-	SniffingType := "http,tls"
-	UDPTimeout := 1 * time.Minute
+
+	opts, err := engine.ParseOptions(C.GoString(options))
+	if err != nil {
+		return cPrintln("invalid options: " + err.Error())
+	}
 
 	// Open the tun device.
 	dnsServers := strings.Split(TunDNS, ",")
@@ -59,7 +55,7 @@ func StartTun2Ray(tunName *C.char, tunAddr *C.char, tunGw *C.char, tunMask *C.ch
 	// Setup TCP/IP stack.
 	lwipWriter := core.NewLWIPStack().(io.Writer)
 
-	str := startV2Ray(Config, SniffingType, ExceptionApps, SendThrough, UDPTimeout)
+	str := startV2Ray(Config, opts)
 	if str != "" {
 		return C.CString(str)
 	}
@@ -73,15 +69,17 @@ func StartTun2Ray(tunName *C.char, tunAddr *C.char, tunGw *C.char, tunMask *C.ch
 			fmt.Println("tunDev is Closed")
 			return 0, nil
 		}
-		return tunDev.Write(data)
+		n, err := tunDev.Write(data)
+		engine.Tun.Written(n)
+		return n, err
 	})
 
 	// Copy packets from tun device to lwip stack, it's the main loop.
-	buf := make([]byte, MTU)
+	buf := make([]byte, opts.MTU)
 	go func() {
-		_, err := io.CopyBuffer(lwipWriter, tunDev, buf)
+		_, err := io.CopyBuffer(lwipWriter, engine.Tun.Reader(tunDev), buf)
 		if err != nil {
-			fmt.Println("copying data failed: %v", err)
+			fmt.Printf("copying data failed: %v\n", err)
 			return
 		}
 	}()
@@ -110,92 +108,41 @@ func StopTun2Ray() *C.char {
 		lwipStack = nil
 	}
 	// Close v2ray instance
-	if v != nil {
-		err := v.Close()
+	if e != nil {
+		err := e.Close()
 		if err != nil {
 			return cPrintln(err.Error())
 		}
-		v = nil
+		e = nil
 	}
 	fmt.Println("Stoped")
 	return C.CString("")
 }
 
-func startV2Ray(config string, sniffingType string, exceptionApps string,
-	exceptionSendThrough string, UDPTimeout time.Duration) string {
+func startV2Ray(config string, opts *engine.Options) string {
 
 	// Change V2ray asset path to the current path
 	// to access geosite.dat & geoipdat
-	path, err := os.Getwd()
-	if err != nil {
-		return fmt.Sprintln(err.Error())
-	}
-	os.Setenv("v2ray.location.asset", path)
-
-	// Share the buffer pool.
-	core.SetBufferPool(vbytespool.GetPool(core.BufSize))
-
-	// Converte config to bytes.
-	configBytes := []byte(config)
-
-	// Start the V2Ray instance.
-	v, err = vcore.StartInstance("json", configBytes)
-	if err != nil {
-		return fmt.Sprintln("start V instance failed " + err.Error())
-	}
-
-	// Configure sniffing settings for traffic coming from tun2socks.
-	var validSniffings []string
-	sniffings := strings.Split(sniffingType, ",")
-	for _, s := range sniffings {
-		if s == "http" || s == "tls" {
-			validSniffings = append(validSniffings, s)
+	if opts.AssetDir == "" {
+		path, err := os.Getwd()
+		if err != nil {
+			return fmt.Sprintln(err.Error())
 		}
+		opts.AssetDir = path
 	}
-	sniffingConfig := &vproxyman.SniffingConfig{
-		Enabled:             true,
-		DestinationOverride: validSniffings,
-	}
-	if len(validSniffings) == 0 {
-		sniffingConfig.Enabled = false
-	}
-	ctx := ContextWithSniffingConfig(context.Background(), sniffingConfig)
-
-	// Create v2ray handlers.
-	v2rayTCPConnHandler := v2ray.NewTCPHandler(ctx, v)
-	v2rayUDPConnHandler := v2ray.NewUDPHandler(ctx, v, UDPTimeout)
 
-	// Resolve the gateway address.
-	sendThrough, err := net.ResolveTCPAddr("tcp", exceptionSendThrough)
+	// Start the V2Ray instance and create the handlers.
+	var err error
+	e, err = engine.New([]byte(config), opts, d.LsofLookup)
 	if err != nil {
-		return fmt.Sprintln("invalid exception send through address: " + err.Error())
+		return fmt.Sprintln(err.Error())
 	}
-	// Prepare the apps list.
-	apps := strings.Split(exceptionApps, ",")
-
-	// Create d handlers
-	tcpHandler := d.NewTCPHandler(v2rayTCPConnHandler, apps, sendThrough)
-	udpHandler := d.NewUDPHandler(v2rayUDPConnHandler, apps, sendThrough, UDPTimeout)
 
 	// Register tun2socks connection handlers.
-	core.RegisterTCPConnHandler(tcpHandler)
-	core.RegisterUDPConnHandler(udpHandler)
+	e.Register()
 	return ""
 }
 
-// ContextWithSniffingConfig is a wrapper of session.ContextWithContent.
-// Deprecated. Use session.ContextWithContent directly.
-func ContextWithSniffingConfig(ctx context.Context, c *vproxyman.SniffingConfig) context.Context {
-	content := session.ContentFromContext(ctx)
-	if content == nil {
-		content = new(session.Content)
-		ctx = session.ContextWithContent(ctx, content)
-	}
-	content.SniffingRequest.Enabled = c.Enabled
-	content.SniffingRequest.OverrideDestinationForProtocol = c.DestinationOverride
-	return ctx
-}
-
 //CPrintln print string and return its length
 func cPrintln(msg string) *C.char {
 